@@ -0,0 +1,120 @@
+package mux
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+var testPSK = []byte("sing-mux test pre-shared key")
+
+func newAuthRequest(psk []byte) Request {
+	request := Request{
+		Version:  Version2,
+		Protocol: ProtocolSingMux,
+		Jitter:   &JitterOptions{MinDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond, Burst: 2},
+	}
+	request.Authenticate(psk)
+	return request
+}
+
+func encodeAuthRequest(request Request) []byte {
+	buffer := EncodeRequest(request, nil)
+	defer buffer.Release()
+	return append([]byte(nil), buffer.Bytes()...)
+}
+
+func readVerifyRequest(data []byte, psk []byte) (*Request, error) {
+	request, err := ReadRequest(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return request, request.Verify(psk)
+}
+
+func TestAuthRoundTrip(t *testing.T) {
+	request := newAuthRequest(testPSK)
+	decoded, err := readVerifyRequest(encodeAuthRequest(request), testPSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *decoded.Auth != *request.Auth || *decoded.Jitter != *request.Jitter {
+		t.Fatal("request mismatch")
+	}
+}
+
+func TestAuthTampered(t *testing.T) {
+	data := encodeAuthRequest(newAuthRequest(testPSK))
+	for _, tamper := range []struct {
+		name   string
+		modify func(data []byte)
+	}{
+		{"protocol", func(data []byte) { data[1] = ProtocolYAMux }},
+		{"flags", func(data []byte) { data[2] &^= requestFlagJitter }},
+		{"timestamp", func(data []byte) { data[3+7]++ }},
+		{"nonce", func(data []byte) { data[3+8] ^= 1 }},
+		{"mac", func(data []byte) { data[3+8+authNonceLen] ^= 1 }},
+		{"options", func(data []byte) { data[len(data)-1] ^= 1 }},
+	} {
+		tampered := append([]byte(nil), data...)
+		tamper.modify(tampered)
+		_, err := readVerifyRequest(tampered, testPSK)
+		if err == nil {
+			t.Fatal("tampered ", tamper.name, " verified")
+		}
+	}
+}
+
+func TestAuthWrongPSK(t *testing.T) {
+	_, err := readVerifyRequest(encodeAuthRequest(newAuthRequest(testPSK)), []byte("wrong key"))
+	if err == nil {
+		t.Fatal("verified with wrong pre-shared key")
+	}
+	request := Request{Version: Version2, Protocol: ProtocolSingMux}
+	_, err = readVerifyRequest(encodeAuthRequest(request), testPSK)
+	if err == nil {
+		t.Fatal("verified without authentication")
+	}
+}
+
+func TestAuthReplay(t *testing.T) {
+	filter := newReplayFilter()
+	request := newAuthRequest(testPSK)
+	if !filter.check(request.Auth) {
+		t.Fatal("fresh nonce rejected")
+	}
+	replayed, err := readVerifyRequest(encodeAuthRequest(request), testPSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.check(replayed.Auth) {
+		t.Fatal("replayed nonce accepted")
+	}
+	if !filter.check(newAuthRequest(testPSK).Auth) {
+		t.Fatal("fresh nonce rejected")
+	}
+}
+
+func TestAuthClockSkew(t *testing.T) {
+	const margin = 5 * time.Second
+	for _, skew := range []struct {
+		offset time.Duration
+		valid  bool
+	}{
+		{AuthTimeWindow - margin, true},
+		{-AuthTimeWindow + margin, true},
+		{AuthTimeWindow + margin, false},
+		{-AuthTimeWindow - margin, false},
+	} {
+		request := Request{Version: Version2, Protocol: ProtocolSingMux}
+		auth := &RequestAuth{Timestamp: time.Now().Add(skew.offset).Unix()}
+		copy(auth.MAC[:], request.authMAC(testPSK, auth.Timestamp, auth.Nonce[:]))
+		request.Auth = auth
+		_, err := readVerifyRequest(encodeAuthRequest(request), testPSK)
+		if skew.valid && err != nil {
+			t.Fatal("skew ", skew.offset, ": ", err)
+		} else if !skew.valid && err == nil {
+			t.Fatal("skew ", skew.offset, " verified")
+		}
+	}
+}
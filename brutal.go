@@ -6,7 +6,6 @@ import (
 
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
-	E "github.com/sagernet/sing/common/exceptions"
 	"github.com/sagernet/sing/common/varbin"
 )
 
@@ -56,6 +55,6 @@ func ReadBrutalResponse(reader io.Reader) (uint64, error) {
 		if err != nil {
 			return 0, err
 		}
-		return 0, E.New("remote error: ", message)
+		return 0, &RemoteError{Code: ErrorCodeGeneral, Message: message}
 	}
 }
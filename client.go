@@ -2,8 +2,11 @@ package mux
 
 import (
 	"context"
+	"errors"
 	"net"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/bufio"
@@ -14,6 +17,8 @@ import (
 	"github.com/sagernet/sing/common/x/list"
 )
 
+const sessionMaintainInterval = 10 * time.Second
+
 type Client struct {
 	dialer         N.Dialer
 	logger         logger.Logger
@@ -22,9 +27,27 @@ type Client struct {
 	minStreams     int
 	maxStreams     int
 	padding        bool
+	paddingScheme  *PaddingScheme
+	shaping        *ShapingOptions
+	jitter         *JitterOptions
+	handshake      HandshakeMode
+	packetBatch    bool
 	access         sync.Mutex
-	connections    list.List[abstractSession]
+	connections    list.List[*clientSession]
 	brutal         BrutalOptions
+	healthCheck    HealthCheckOptions
+	selector       SessionSelector
+	minSessions    int
+	maintainNotify chan struct{}
+	maintainDone   chan struct{}
+	done           chan struct{}
+	closeOnce      sync.Once
+	maxAge         time.Duration
+	maxStreamCount int
+	maxBytes       uint64
+	stats          statsCounters
+	tracer         *Tracer
+	psk            []byte
 }
 
 type Options struct {
@@ -36,6 +59,37 @@ type Options struct {
 	MaxStreams     int
 	Padding        bool
 	Brutal         BrutalOptions
+	HealthCheck    HealthCheckOptions
+	// PaddingScheme overrides DefaultPaddingScheme when Padding is enabled.
+	// It is announced to the server, which must support Version2 requests.
+	PaddingScheme *PaddingScheme
+	// Shaping keeps padded sessions shaped for their whole lifetime when Padding is enabled.
+	// It is announced to the server, which must support Version2 requests.
+	Shaping *ShapingOptions
+	// Jitter delays session writes on a randomized schedule to obscure their timing.
+	// It is announced to the server, which must support Version2 requests.
+	Jitter *JitterOptions
+	// SessionSelector overrides how sessions are picked for new streams.
+	// MaxConnections, MinStreams and MaxStreams only apply to the default selector.
+	SessionSelector SessionSelector
+	// MinSessions keeps at least this many sessions established, dialing them in the background
+	// so that new streams do not wait for session setup. It is capped by MaxConnections.
+	MinSessions int
+	// MaxSessionAge, MaxSessionStreams and MaxSessionBytes rotate sessions: once a session is older,
+	// has opened more streams or has transferred more bytes than allowed, it stops taking new streams
+	// and is closed when its last stream finishes.
+	MaxSessionAge     time.Duration
+	MaxSessionStreams int
+	MaxSessionBytes   uint64
+	Tracer            *Tracer
+	// PreSharedKey authenticates sessions to a Service configured with the same key.
+	PreSharedKey []byte
+	// Handshake controls when streams send their request, and may be overridden per stream with ContextWithHandshakeMode.
+	Handshake HandshakeMode
+	// PacketBatch frames UDP streams in batches, allowing packets larger than 65535 bytes and
+	// sending the packets written together with PacketBatchWriter in a single write.
+	// It is announced in stream requests to the server, which must support it.
+	PacketBatch bool
 }
 
 type BrutalOptions struct {
@@ -44,6 +98,15 @@ type BrutalOptions struct {
 	ReceiveBPS uint64
 }
 
+// HealthCheckOptions enables periodic pings on client sessions. A session is
+// closed and evicted after FailureThreshold consecutive failed pings.
+// smux has no pings, so smux sessions send NOP keepalives at Interval, and fail a ping when no frame arrived
+// within the last Interval and a half: services must send keepalives too, see ServiceOptions.SmuxKeepAliveInterval.
+type HealthCheckOptions struct {
+	Interval         time.Duration
+	FailureThreshold int
+}
+
 func NewClient(options Options) (*Client, error) {
 	client := &Client{
 		dialer:         options.Dialer,
@@ -52,7 +115,45 @@ func NewClient(options Options) (*Client, error) {
 		minStreams:     options.MinStreams,
 		maxStreams:     options.MaxStreams,
 		padding:        options.Padding,
+		paddingScheme:  options.PaddingScheme,
+		shaping:        options.Shaping,
+		jitter:         options.Jitter,
+		handshake:      options.Handshake,
+		packetBatch:    options.PacketBatch,
 		brutal:         options.Brutal,
+		healthCheck:    options.HealthCheck,
+		minSessions:    options.MinSessions,
+		maxAge:         options.MaxSessionAge,
+		maxStreamCount: options.MaxSessionStreams,
+		maxBytes:       options.MaxSessionBytes,
+		tracer:         options.Tracer,
+		psk:            options.PreSharedKey,
+		maintainNotify: make(chan struct{}, 1),
+		done:           make(chan struct{}),
+	}
+	if client.maxConnections > 0 && client.minSessions > client.maxConnections {
+		client.minSessions = client.maxConnections
+	}
+	if client.healthCheck.Interval > 0 && client.healthCheck.FailureThreshold == 0 {
+		client.healthCheck.FailureThreshold = 3
+	}
+	if client.paddingScheme != nil {
+		err := client.paddingScheme.Validate()
+		if err != nil {
+			return nil, E.Cause(err, "validate padding scheme")
+		}
+	}
+	if client.shaping != nil {
+		err := client.shaping.Validate()
+		if err != nil {
+			return nil, E.Cause(err, "validate shaping options")
+		}
+	}
+	if client.jitter != nil {
+		err := client.jitter.Validate()
+		if err != nil {
+			return nil, E.Cause(err, "validate jitter options")
+		}
 	}
 	if client.dialer == nil {
 		client.dialer = N.SystemDialer
@@ -60,6 +161,17 @@ func NewClient(options Options) (*Client, error) {
 	if client.maxStreams == 0 && client.maxConnections == 0 {
 		client.minStreams = 8
 	}
+	if options.SessionSelector != nil {
+		client.selector = options.SessionSelector
+	} else if client.brutal.Enabled {
+		client.selector = &brutalSessionSelector{}
+	} else {
+		client.selector = &DefaultSessionSelector{
+			MaxConnections: client.maxConnections,
+			MinStreams:     client.minStreams,
+			MaxStreams:     client.maxStreams,
+		}
+	}
 	switch options.Protocol {
 	case "", "h2mux":
 		client.protocol = ProtocolH2Mux
@@ -67,49 +179,104 @@ func NewClient(options Options) (*Client, error) {
 		client.protocol = ProtocolSmux
 	case "yamux":
 		client.protocol = ProtocolYAMux
+	case "singmux":
+		client.protocol = ProtocolSingMux
 	default:
 		return nil, E.New("unknown protocol: " + options.Protocol)
 	}
+	client.startMaintainer()
 	return client, nil
 }
 
 func (c *Client) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
 	switch N.NetworkName(network) {
 	case N.NetworkTCP:
-		stream, err := c.openStream(ctx)
+		stream, err := c.openStream(ctx, N.NetworkTCP, destination)
+		if err != nil {
+			return nil, err
+		}
+		conn := &clientConn{Conn: stream, destination: destination, tracer: c.tracer}
+		err = c.handshakeStream(ctx, stream, func() error {
+			return common.Error(conn.Write(nil))
+		}, func() error {
+			err := conn.readResponse()
+			conn.responseRead = err == nil
+			return err
+		})
 		if err != nil {
+			conn.Close()
 			return nil, err
 		}
-		return &clientConn{Conn: stream, destination: destination}, nil
+		if canCloseWrite(stream) {
+			return &halfCloseClientConn{conn}, nil
+		}
+		return conn, nil
 	case N.NetworkUDP:
-		stream, err := c.openStream(ctx)
+		stream, err := c.openStream(ctx, N.NetworkUDP, destination)
 		if err != nil {
 			return nil, err
 		}
 		extendedConn := bufio.NewExtendedConn(stream)
-		return &clientPacketConn{AbstractConn: extendedConn, conn: extendedConn, destination: destination}, nil
+		packetConn := &clientPacketConn{
+			AbstractConn: extendedConn,
+			conn:         extendedConn,
+			destination:  destination,
+			tracer:       c.tracer,
+			framing:      packetFraming{batch: c.packetBatch},
+		}
+		err = c.handshakeStream(ctx, stream, func() error {
+			return common.Error(packetConn.writeRequest(nil))
+		}, func() error {
+			err := packetConn.readResponse()
+			packetConn.responseRead = err == nil
+			return err
+		})
+		if err != nil {
+			packetConn.Close()
+			return nil, err
+		}
+		return packetConn, nil
 	default:
 		return nil, E.Extend(N.ErrUnknownNetwork, network)
 	}
 }
 
 func (c *Client) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
-	stream, err := c.openStream(ctx)
+	stream, err := c.openStream(ctx, N.NetworkUDP, destination)
 	if err != nil {
 		return nil, err
 	}
 	extendedConn := bufio.NewExtendedConn(stream)
-	return &clientPacketAddrConn{AbstractConn: extendedConn, conn: extendedConn, destination: destination}, nil
+	packetConn := &clientPacketAddrConn{
+		AbstractConn: extendedConn,
+		conn:         extendedConn,
+		destination:  destination,
+		tracer:       c.tracer,
+		framing:      packetFraming{addr: true, batch: c.packetBatch},
+	}
+	err = c.handshakeStream(ctx, stream, func() error {
+		return common.Error(packetConn.writeRequest(nil, M.Socksaddr{}))
+	}, func() error {
+		err := packetConn.readResponse()
+		packetConn.responseRead = err == nil
+		return err
+	})
+	if err != nil {
+		packetConn.Close()
+		return nil, err
+	}
+	return packetConn, nil
 }
 
-func (c *Client) openStream(ctx context.Context) (net.Conn, error) {
+func (c *Client) openStream(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
 	var (
-		session abstractSession
+		session *clientSession
 		stream  net.Conn
 		err     error
 	)
+	start := time.Now()
 	for attempts := 0; attempts < 2; attempts++ {
-		session, err = c.offer(ctx)
+		session, err = c.offer(ctx, destination)
 		if err != nil {
 			continue
 		}
@@ -122,90 +289,243 @@ func (c *Client) openStream(ctx context.Context) (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &wrapStream{stream}, nil
+	c.stats.addStreamOpenLatency(time.Since(start))
+	c.tracer.streamOpen(destination, network)
+	stream = newStatsStream(stream, session.stats)
+	session.onStreamOpened()
+	return &wrapStream{&clientStream{Conn: stream, session: session}}, nil
 }
 
-func (c *Client) offer(ctx context.Context) (abstractSession, error) {
+func (c *Client) offer(ctx context.Context, destination M.Socksaddr) (*clientSession, error) {
 	c.access.Lock()
 	defer c.access.Unlock()
 
-	var sessions []abstractSession
+	select {
+	case <-c.done:
+		return nil, net.ErrClosed
+	default:
+	}
+	c.startMaintainer()
+	sessions := c.liveSessions()
+	selected := c.selector.Select(sessions, destination)
+	if selected == nil {
+		return c.offerNew(ctx)
+	}
+	session, isClientSession := selected.(*clientSession)
+	if !isClientSession {
+		return nil, E.New("session selector returned an unknown session")
+	}
+	return session, nil
+}
+
+// liveSessions must be called with access held. Closed sessions are pruned and the maintainer is notified.
+func (c *Client) liveSessions() []Session {
+	var (
+		sessions []Session
+		pruned   bool
+	)
 	for element := c.connections.Front(); element != nil; {
+		element.Value.closeIfDrained()
 		if element.Value.IsClosed() {
-			element.Value.Close()
+			element.Value.closeWithError(ErrSessionClosed)
 			nextElement := element.Next()
 			c.connections.Remove(element)
 			element = nextElement
+			pruned = true
 			continue
 		}
 		sessions = append(sessions, element.Value)
 		element = element.Next()
 	}
-	if c.brutal.Enabled {
-		if len(sessions) > 0 {
-			return sessions[0], nil
-		}
-		return c.offerNew(ctx)
+	if pruned {
+		c.notifyMaintainer()
 	}
-	session := common.MinBy(common.Filter(sessions, abstractSession.CanTakeNewRequest), abstractSession.NumStreams)
-	if session == nil {
-		return c.offerNew(ctx)
+	return sessions
+}
+
+func (c *Client) offerNew(ctx context.Context) (*clientSession, error) {
+	session, err := c.newSession(ctx)
+	if err != nil {
+		return nil, err
 	}
-	numStreams := session.NumStreams()
-	if numStreams == 0 {
-		return session, nil
+	c.addSession(session)
+	return session, nil
+}
+
+// addSession must be called with access held.
+func (c *Client) addSession(session *clientSession) {
+	if c.maxAge > 0 {
+		session.ageTimer = time.AfterFunc(c.maxAge, session.drain)
 	}
-	if c.maxConnections > 0 {
-		if len(sessions) >= c.maxConnections || numStreams < c.minStreams {
-			return session, nil
-		}
-	} else {
-		if c.maxStreams > 0 && numStreams < c.maxStreams {
-			return session, nil
-		}
+	c.connections.PushBack(session)
+	if c.healthCheck.Interval > 0 {
+		go c.loopHealthCheck(session)
 	}
-	return c.offerNew(ctx)
 }
 
-func (c *Client) offerNew(ctx context.Context) (abstractSession, error) {
+func (c *Client) newSession(ctx context.Context) (*clientSession, error) {
 	ctx, cancel := context.WithTimeout(ctx, TCPTimeout)
 	defer cancel()
+	c.tracer.sessionDial()
 	conn, err := c.dialer.DialContext(ctx, N.NetworkTCP, Destination)
 	if err != nil {
+		c.stats.addHandshakeFailure(HandshakeFailureDial)
 		return nil, err
 	}
 	var version byte
-	if c.padding {
+	if len(c.psk) > 0 || c.jitter != nil || c.padding && (c.paddingScheme != nil || c.shaping != nil) {
+		version = Version2
+	} else if c.padding {
 		version = Version1
 	} else {
 		version = Version0
 	}
 	conn = newProtocolConn(conn, Request{
-		Version:  version,
-		Protocol: c.protocol,
-		Padding:  c.padding,
-	})
+		Version:       version,
+		Protocol:      c.protocol,
+		Padding:       c.padding,
+		PaddingScheme: c.paddingScheme,
+		Shaping:       c.shaping,
+		Jitter:        c.jitter,
+	}, c.psk)
+	stats := newSessionStats(&c.stats, c.protocol, c.padding, conn.LocalAddr(), conn.RemoteAddr())
 	if c.padding {
-		conn = newPaddingConn(conn)
+		if c.shaping != nil {
+			conn = newShapingConn(conn, c.shaping, stats.addPaddingOverhead)
+		} else {
+			conn = newPaddingConn(conn, version, c.paddingScheme, stats.addPaddingOverhead)
+		}
 	}
-	session, err := newClientSession(conn, c.protocol)
+	if c.jitter != nil {
+		conn = newJitterConn(conn, c.jitter)
+	}
+	session, err := newClientSession(conn, c.protocol, c.healthCheck)
 	if err != nil {
+		c.stats.addHandshakeFailure(HandshakeFailureSession)
 		conn.Close()
 		return nil, err
 	}
 	if c.brutal.Enabled {
-		err = c.brutalExchange(ctx, conn, session)
+		err = c.brutalExchange(ctx, conn, session, stats)
 		if err != nil {
+			c.stats.addHandshakeFailure(HandshakeFailureBrutal)
 			conn.Close()
 			session.Close()
 			return nil, E.Cause(err, "brutal exchange")
 		}
 	}
-	c.connections.PushBack(session)
-	return session, nil
+	c.tracer.sessionEstablished(c.protocol)
+	return &clientSession{abstractSession: session, client: c, stats: stats}, nil
 }
 
-func (c *Client) brutalExchange(ctx context.Context, sessionConn net.Conn, session abstractSession) error {
+func (c *Client) notifyMaintainer() {
+	select {
+	case c.maintainNotify <- struct{}{}:
+	default:
+	}
+}
+
+// startMaintainer must be called with access held.
+func (c *Client) startMaintainer() {
+	if c.minSessions == 0 || c.maintainDone != nil {
+		return
+	}
+	c.maintainDone = make(chan struct{})
+	go c.loopMaintainSessions(c.maintainDone)
+}
+
+// stopMaintainer must be called with access held.
+func (c *Client) stopMaintainer() {
+	if c.maintainDone != nil {
+		close(c.maintainDone)
+		c.maintainDone = nil
+	}
+}
+
+func (c *Client) loopMaintainSessions(done chan struct{}) {
+	ticker := time.NewTicker(sessionMaintainInterval)
+	defer ticker.Stop()
+	for {
+		c.maintainSessions(done)
+		select {
+		case <-ticker.C:
+		case <-c.maintainNotify:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (c *Client) maintainSessions(done chan struct{}) {
+	c.access.Lock()
+	missing := c.minSessions - len(c.liveSessions())
+	c.access.Unlock()
+	for ; missing > 0; missing-- {
+		session, err := c.newSession(context.Background())
+		if err != nil {
+			c.logger.Debug(E.Cause(err, "pre-establish multiplex session"))
+			return
+		}
+		c.access.Lock()
+		select {
+		case <-done:
+			c.access.Unlock()
+			session.Close()
+			return
+		default:
+		}
+		// sessions may have been dialed by offerNew meanwhile, which also keeps MaxConnections
+		if len(c.liveSessions()) >= c.minSessions {
+			c.access.Unlock()
+			session.Close()
+			return
+		}
+		c.addSession(session)
+		c.access.Unlock()
+	}
+}
+
+func (c *Client) loopHealthCheck(session *clientSession) {
+	ticker := time.NewTicker(c.healthCheck.Interval)
+	defer ticker.Stop()
+	var failures int
+	for range ticker.C {
+		if session.IsClosed() {
+			return
+		}
+		rtt, err := session.Ping()
+		if errors.Is(err, os.ErrInvalid) {
+			return
+		}
+		if err == nil {
+			failures = 0
+			session.rtt.Store(int64(rtt))
+			continue
+		}
+		failures++
+		c.logger.Debug(E.Cause(err, "ping multiplex session"))
+		if failures >= c.healthCheck.FailureThreshold {
+			c.logger.Debug("evict multiplex session after ", failures, " failed pings")
+			c.evict(session, err)
+			return
+		}
+	}
+}
+
+func (c *Client) evict(session *clientSession, err error) {
+	c.access.Lock()
+	for element := c.connections.Front(); element != nil; element = element.Next() {
+		if element.Value == session {
+			c.connections.Remove(element)
+			break
+		}
+	}
+	c.access.Unlock()
+	session.closeWithError(E.Cause(err, "health check"))
+	c.notifyMaintainer()
+}
+
+func (c *Client) brutalExchange(ctx context.Context, sessionConn net.Conn, session abstractSession, stats *sessionStats) error {
 	stream, err := session.Open()
 	if err != nil {
 		return err
@@ -227,6 +547,9 @@ func (c *Client) brutalExchange(ctx context.Context, sessionConn net.Conn, sessi
 	clientBrutalErr := SetBrutalOptions(sessionConn, sendBPS)
 	if clientBrutalErr != nil {
 		c.logger.Debug(E.Cause(clientBrutalErr, "failed to enable TCP Brutal at client"))
+	} else {
+		stats.brutalSendBPS.Store(sendBPS)
+		c.tracer.brutalNegotiated(sendBPS)
 	}
 	return nil
 }
@@ -234,13 +557,65 @@ func (c *Client) brutalExchange(ctx context.Context, sessionConn net.Conn, sessi
 func (c *Client) Reset() {
 	c.access.Lock()
 	defer c.access.Unlock()
+	c.resetLocked()
+	c.notifyMaintainer()
+}
+
+// resetLocked must be called with access held.
+func (c *Client) resetLocked() {
 	for _, session := range c.connections.Array() {
 		session.Close()
 	}
 	c.connections.Init()
 }
 
+// Stats returns a snapshot of the live sessions of the client.
+func (c *Client) Stats() Stats {
+	c.access.Lock()
+	defer c.access.Unlock()
+	stats := c.stats.snapshot()
+	for element := c.connections.Front(); element != nil; element = element.Next() {
+		if element.Value.IsClosed() {
+			continue
+		}
+		stats.Sessions = append(stats.Sessions, element.Value.stats.snapshot(element.Value))
+	}
+	return stats
+}
+
+// Shutdown stops opening new streams and waits for the streams of existing sessions to finish,
+// then closes all sessions. Sessions are closed immediately once ctx is done. The client can not be used afterwards.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	c.access.Lock()
+	c.stopMaintainer()
+	sessions := make([]abstractSession, 0, c.connections.Len())
+	for element := c.connections.Front(); element != nil; element = element.Next() {
+		sessions = append(sessions, element.Value)
+	}
+	c.connections.Init()
+	c.access.Unlock()
+	for _, session := range sessions {
+		err := session.Shutdown()
+		if err != nil {
+			c.logger.Debug(E.Cause(err, "shutdown multiplex session"))
+		}
+	}
+	err := waitSessionsIdle(ctx, sessions)
+	for _, session := range sessions {
+		session.Close()
+	}
+	return err
+}
+
+// Close closes all sessions and stops pre-establishing them. Unlike Shutdown, it leaves the client usable,
+// and new streams dial sessions again.
 func (c *Client) Close() error {
-	c.Reset()
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.stopMaintainer()
+	c.resetLocked()
 	return nil
 }
@@ -1,23 +1,24 @@
 package mux
 
 import (
-	"encoding/binary"
 	"io"
 	"net"
 	"sync"
 
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
-	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
 )
 
 type clientConn struct {
 	net.Conn
-	destination    M.Socksaddr
-	requestWritten bool
-	responseRead   bool
+	destination     M.Socksaddr
+	tracer          *Tracer
+	requestWritten  bool
+	responseRead    bool
+	readWaitOptions N.ReadWaitOptions
+	readWaiter      N.ReadWaiter
 }
 
 func (c *clientConn) NeedHandshake() bool {
@@ -26,13 +27,14 @@ func (c *clientConn) NeedHandshake() bool {
 
 func (c *clientConn) readResponse() error {
 	response, err := ReadStreamResponse(c.Conn)
-	if err != nil {
-		return err
-	}
-	if response.Status == statusError {
-		return E.New("remote error: ", response.Message)
+	if err == nil {
+		err = streamResponseError(response, c.destination)
+	} else {
+		err = readResponseError(err, c.destination)
 	}
-	return nil
+	drainGoingAway(c.Conn, err)
+	c.tracer.streamResponse(err)
+	return err
 }
 
 func (c *clientConn) Read(b []byte) (n int, err error) {
@@ -53,6 +55,7 @@ func (c *clientConn) Write(b []byte) (n int, err error) {
 	request := StreamRequest{
 		Network:     N.NetworkTCP,
 		Destination: c.destination,
+		ErrorCodes:  true,
 	}
 	buffer := buf.NewSize(streamRequestLen(request) + len(b))
 	defer buffer.Release()
@@ -93,6 +96,30 @@ func (c *clientConn) Upstream() any {
 	return c.Conn
 }
 
+func (c *clientConn) SessionInfo() SessionInfo {
+	return sessionInfoOf(c.Conn)
+}
+
+func (c *clientConn) Reset(code ErrorCode) error {
+	return resetStream(c.Conn, code)
+}
+
+// halfCloseClientConn is the clientConn of a stream that can be half-closed.
+type halfCloseClientConn struct {
+	*clientConn
+}
+
+// CloseWrite sends the request first if nothing has been written, so that the stream is still opened.
+func (c *halfCloseClientConn) CloseWrite() error {
+	if !c.requestWritten {
+		_, err := c.Write(nil)
+		if err != nil {
+			return err
+		}
+	}
+	return N.CloseWrite(c.Conn)
+}
+
 var _ N.NetPacketConn = (*clientPacketConn)(nil)
 
 type clientPacketConn struct {
@@ -100,6 +127,8 @@ type clientPacketConn struct {
 	conn            N.ExtendedConn
 	access          sync.Mutex
 	destination     M.Socksaddr
+	tracer          *Tracer
+	framing         packetFraming
 	requestWritten  bool
 	responseRead    bool
 	readWaitOptions N.ReadWaitOptions
@@ -111,13 +140,14 @@ func (c *clientPacketConn) NeedHandshake() bool {
 
 func (c *clientPacketConn) readResponse() error {
 	response, err := ReadStreamResponse(c.conn)
-	if err != nil {
-		return err
-	}
-	if response.Status == statusError {
-		return E.New("remote error: ", response.Message)
+	if err == nil {
+		err = streamResponseError(response, c.destination)
+	} else {
+		err = readResponseError(err, c.destination)
 	}
-	return nil
+	drainGoingAway(c.conn, err)
+	c.tracer.streamResponse(err)
+	return err
 }
 
 func (c *clientPacketConn) Read(b []byte) (n int, err error) {
@@ -128,12 +158,12 @@ func (c *clientPacketConn) Read(b []byte) (n int, err error) {
 		}
 		c.responseRead = true
 	}
-	var length uint16
-	err = binary.Read(c.conn, binary.BigEndian, &length)
+	var length int
+	_, length, err = c.framing.readHeader(c.conn)
 	if err != nil {
 		return
 	}
-	if cap(b) < int(length) {
+	if cap(b) < length {
 		return 0, io.ErrShortBuffer
 	}
 	return io.ReadFull(c.conn, b[:length])
@@ -143,10 +173,12 @@ func (c *clientPacketConn) writeRequest(payload []byte) (n int, err error) {
 	request := StreamRequest{
 		Network:     N.NetworkUDP,
 		Destination: c.destination,
+		ErrorCodes:  true,
+		PacketBatch: c.framing.batch,
 	}
 	rLen := streamRequestLen(request)
 	if len(payload) > 0 {
-		rLen += 2 + len(payload)
+		rLen += c.framing.singleHeaderLen(M.Socksaddr{}) + len(payload)
 	}
 	buffer := buf.NewSize(rLen)
 	defer buffer.Release()
@@ -155,10 +187,11 @@ func (c *clientPacketConn) writeRequest(payload []byte) (n int, err error) {
 		return
 	}
 	if len(payload) > 0 {
-		common.Must(
-			binary.Write(buffer, binary.BigEndian, uint16(len(payload))),
-			common.Error(buffer.Write(payload)),
-		)
+		err = c.framing.writeHeader(buffer, M.Socksaddr{}, len(payload))
+		if err != nil {
+			return
+		}
+		common.Must1(buffer.Write(payload))
 	}
 	_, err = c.conn.Write(buffer.Bytes())
 	if err != nil {
@@ -178,13 +211,23 @@ func (c *clientPacketConn) Write(b []byte) (n int, err error) {
 			return c.writeRequest(b)
 		}
 	}
-	err = binary.Write(c.conn, binary.BigEndian, uint16(len(b)))
+	err = c.writeHeader(len(b))
 	if err != nil {
 		return
 	}
 	return c.conn.Write(b)
 }
 
+func (c *clientPacketConn) writeHeader(length int) error {
+	header := buf.NewSize(c.framing.singleHeaderLen(M.Socksaddr{}))
+	defer header.Release()
+	err := c.framing.writeHeader(header, M.Socksaddr{}, length)
+	if err != nil {
+		return err
+	}
+	return common.Error(c.conn.Write(header.Bytes()))
+}
+
 func (c *clientPacketConn) ReadBuffer(buffer *buf.Buffer) (err error) {
 	if !c.responseRead {
 		err = c.readResponse()
@@ -193,12 +236,12 @@ func (c *clientPacketConn) ReadBuffer(buffer *buf.Buffer) (err error) {
 		}
 		c.responseRead = true
 	}
-	var length uint16
-	err = binary.Read(c.conn, binary.BigEndian, &length)
+	var length int
+	_, length, err = c.framing.readHeader(c.conn)
 	if err != nil {
 		return
 	}
-	_, err = buffer.ReadFullFrom(c.conn, int(length))
+	_, err = buffer.ReadFullFrom(c.conn, length)
 	return
 }
 
@@ -214,12 +257,16 @@ func (c *clientPacketConn) WriteBuffer(buffer *buf.Buffer) error {
 		}
 	}
 	bLen := buffer.Len()
-	binary.BigEndian.PutUint16(buffer.ExtendHeader(2), uint16(bLen))
+	err := c.framing.writeHeader(buf.With(buffer.ExtendHeader(c.framing.singleHeaderLen(M.Socksaddr{}))), M.Socksaddr{}, bLen)
+	if err != nil {
+		buffer.Release()
+		return err
+	}
 	return c.conn.WriteBuffer(buffer)
 }
 
 func (c *clientPacketConn) FrontHeadroom() int {
-	return 2
+	return c.framing.frontHeadroom()
 }
 
 func (c *clientPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
@@ -230,12 +277,12 @@ func (c *clientPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error)
 		}
 		c.responseRead = true
 	}
-	var length uint16
-	err = binary.Read(c.conn, binary.BigEndian, &length)
+	var length int
+	_, length, err = c.framing.readHeader(c.conn)
 	if err != nil {
 		return
 	}
-	if cap(p) < int(length) {
+	if cap(p) < length {
 		return 0, nil, io.ErrShortBuffer
 	}
 	n, err = io.ReadFull(c.conn, p[:length])
@@ -252,7 +299,7 @@ func (c *clientPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 			return c.writeRequest(p)
 		}
 	}
-	err = binary.Write(c.conn, binary.BigEndian, uint16(len(p)))
+	err = c.writeHeader(len(p))
 	if err != nil {
 		return
 	}
@@ -268,6 +315,35 @@ func (c *clientPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksad
 	return c.WriteBuffer(buffer)
 }
 
+func (c *clientPacketConn) WritePacketBatch(buffers []*buf.Buffer, destinations []M.Socksaddr) error {
+	if !c.framing.batch {
+		for i, buffer := range buffers {
+			err := c.WriteBuffer(buffer)
+			if err != nil {
+				buf.ReleaseMulti(buffers[i+1:])
+				return err
+			}
+		}
+		return nil
+	}
+	batch, err := c.framing.encodeBatch(buffers, destinations)
+	if err != nil {
+		return err
+	}
+	defer batch.Release()
+	if !c.requestWritten {
+		c.access.Lock()
+		if !c.requestWritten {
+			_, err = c.writeRequest(nil)
+		}
+		c.access.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return common.Error(c.conn.Write(batch.Bytes()))
+}
+
 func (c *clientPacketConn) LocalAddr() net.Addr {
 	return c.conn.LocalAddr()
 }
@@ -284,6 +360,14 @@ func (c *clientPacketConn) Upstream() any {
 	return c.conn
 }
 
+func (c *clientPacketConn) SessionInfo() SessionInfo {
+	return sessionInfoOf(c.conn)
+}
+
+func (c *clientPacketConn) Reset(code ErrorCode) error {
+	return resetStream(c.conn, code)
+}
+
 var _ N.NetPacketConn = (*clientPacketAddrConn)(nil)
 
 type clientPacketAddrConn struct {
@@ -291,6 +375,8 @@ type clientPacketAddrConn struct {
 	conn            N.ExtendedConn
 	access          sync.Mutex
 	destination     M.Socksaddr
+	tracer          *Tracer
+	framing         packetFraming
 	requestWritten  bool
 	responseRead    bool
 	readWaitOptions N.ReadWaitOptions
@@ -302,13 +388,14 @@ func (c *clientPacketAddrConn) NeedHandshake() bool {
 
 func (c *clientPacketAddrConn) readResponse() error {
 	response, err := ReadStreamResponse(c.conn)
-	if err != nil {
-		return err
-	}
-	if response.Status == statusError {
-		return E.New("remote error: ", response.Message)
+	if err == nil {
+		err = streamResponseError(response, c.destination)
+	} else {
+		err = readResponseError(err, c.destination)
 	}
-	return nil
+	drainGoingAway(c.conn, err)
+	c.tracer.streamResponse(err)
+	return err
 }
 
 func (c *clientPacketAddrConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
@@ -319,7 +406,7 @@ func (c *clientPacketAddrConn) ReadFrom(p []byte) (n int, addr net.Addr, err err
 		}
 		c.responseRead = true
 	}
-	destination, err := M.SocksaddrSerializer.ReadAddrPort(c.conn)
+	destination, length, err := c.framing.readHeader(c.conn)
 	if err != nil {
 		return
 	}
@@ -328,12 +415,7 @@ func (c *clientPacketAddrConn) ReadFrom(p []byte) (n int, addr net.Addr, err err
 	} else {
 		addr = destination.UDPAddr()
 	}
-	var length uint16
-	err = binary.Read(c.conn, binary.BigEndian, &length)
-	if err != nil {
-		return
-	}
-	if cap(p) < int(length) {
+	if cap(p) < length {
 		return 0, nil, io.ErrShortBuffer
 	}
 	n, err = io.ReadFull(c.conn, p[:length])
@@ -344,11 +426,13 @@ func (c *clientPacketAddrConn) writeRequest(payload []byte, destination M.Socksa
 	request := StreamRequest{
 		Network:     N.NetworkUDP,
 		Destination: c.destination,
+		ErrorCodes:  true,
 		PacketAddr:  true,
+		PacketBatch: c.framing.batch,
 	}
 	rLen := streamRequestLen(request)
 	if len(payload) > 0 {
-		rLen += M.SocksaddrSerializer.AddrPortLen(destination) + 2 + len(payload)
+		rLen += c.framing.singleHeaderLen(destination) + len(payload)
 	}
 	buffer := buf.NewSize(rLen)
 	defer buffer.Release()
@@ -357,14 +441,11 @@ func (c *clientPacketAddrConn) writeRequest(payload []byte, destination M.Socksa
 		return
 	}
 	if len(payload) > 0 {
-		err = M.SocksaddrSerializer.WriteAddrPort(buffer, destination)
+		err = c.framing.writeHeader(buffer, destination, len(payload))
 		if err != nil {
 			return
 		}
-		common.Must(
-			binary.Write(buffer, binary.BigEndian, uint16(len(payload))),
-			common.Error(buffer.Write(payload)),
-		)
+		common.Must1(buffer.Write(payload))
 	}
 	_, err = c.conn.Write(buffer.Bytes())
 	if err != nil {
@@ -384,11 +465,14 @@ func (c *clientPacketAddrConn) WriteTo(p []byte, addr net.Addr) (n int, err erro
 			return c.writeRequest(p, M.SocksaddrFromNet(addr))
 		}
 	}
-	err = M.SocksaddrSerializer.WriteAddrPort(c.conn, M.SocksaddrFromNet(addr))
+	destination := M.SocksaddrFromNet(addr)
+	header := buf.NewSize(c.framing.singleHeaderLen(destination))
+	defer header.Release()
+	err = c.framing.writeHeader(header, destination, len(p))
 	if err != nil {
 		return
 	}
-	err = binary.Write(c.conn, binary.BigEndian, uint16(len(p)))
+	_, err = c.conn.Write(header.Bytes())
 	if err != nil {
 		return
 	}
@@ -403,16 +487,12 @@ func (c *clientPacketAddrConn) ReadPacket(buffer *buf.Buffer) (destination M.Soc
 		}
 		c.responseRead = true
 	}
-	destination, err = M.SocksaddrSerializer.ReadAddrPort(c.conn)
+	var length int
+	destination, length, err = c.framing.readHeader(c.conn)
 	if err != nil {
 		return
 	}
-	var length uint16
-	err = binary.Read(c.conn, binary.BigEndian, &length)
-	if err != nil {
-		return
-	}
-	_, err = buffer.ReadFullFrom(c.conn, int(length))
+	_, err = buffer.ReadFullFrom(c.conn, length)
 	return
 }
 
@@ -428,21 +508,49 @@ func (c *clientPacketAddrConn) WritePacket(buffer *buf.Buffer, destination M.Soc
 		}
 	}
 	bLen := buffer.Len()
-	header := buf.With(buffer.ExtendHeader(M.SocksaddrSerializer.AddrPortLen(destination) + 2))
-	err := M.SocksaddrSerializer.WriteAddrPort(header, destination)
+	err := c.framing.writeHeader(buf.With(buffer.ExtendHeader(c.framing.singleHeaderLen(destination))), destination, bLen)
 	if err != nil {
+		buffer.Release()
 		return err
 	}
-	common.Must(binary.Write(header, binary.BigEndian, uint16(bLen)))
 	return c.conn.WriteBuffer(buffer)
 }
 
+func (c *clientPacketAddrConn) WritePacketBatch(buffers []*buf.Buffer, destinations []M.Socksaddr) error {
+	if !c.framing.batch {
+		for i, buffer := range buffers {
+			err := c.WritePacket(buffer, destinations[i])
+			if err != nil {
+				buf.ReleaseMulti(buffers[i+1:])
+				return err
+			}
+		}
+		return nil
+	}
+	batch, err := c.framing.encodeBatch(buffers, destinations)
+	if err != nil {
+		return err
+	}
+	defer batch.Release()
+	if !c.requestWritten {
+		c.access.Lock()
+		if !c.requestWritten {
+			_, err = c.writeRequest(nil, M.Socksaddr{})
+		}
+		c.access.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return common.Error(c.conn.Write(batch.Bytes()))
+}
+
 func (c *clientPacketAddrConn) LocalAddr() net.Addr {
 	return c.conn.LocalAddr()
 }
 
 func (c *clientPacketAddrConn) FrontHeadroom() int {
-	return 2 + M.MaxSocksaddrLength
+	return c.framing.frontHeadroom()
 }
 
 func (c *clientPacketAddrConn) NeedAdditionalReadDeadline() bool {
@@ -452,3 +560,11 @@ func (c *clientPacketAddrConn) NeedAdditionalReadDeadline() bool {
 func (c *clientPacketAddrConn) Upstream() any {
 	return c.conn
 }
+
+func (c *clientPacketAddrConn) SessionInfo() SessionInfo {
+	return sessionInfoOf(c.conn)
+}
+
+func (c *clientPacketAddrConn) Reset(code ErrorCode) error {
+	return resetStream(c.conn, code)
+}
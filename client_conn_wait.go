@@ -1,13 +1,53 @@
 package mux
 
 import (
-	"encoding/binary"
+	"io"
 
 	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
 )
 
+var _ N.ReadWaiter = (*clientConn)(nil)
+
+// InitializeReadWaiter passes reads through to the read waiter of the stream, if the protocol has one.
+func (c *clientConn) InitializeReadWaiter(options N.ReadWaitOptions) (needCopy bool) {
+	c.readWaitOptions = options
+	c.readWaiter, _ = bufio.CreateReadWaiter(c.Conn)
+	if c.readWaiter != nil {
+		return c.readWaiter.InitializeReadWaiter(options)
+	}
+	return false
+}
+
+func (c *clientConn) WaitReadBuffer() (buffer *buf.Buffer, err error) {
+	if !c.responseRead {
+		err = c.readResponse()
+		if err != nil {
+			return
+		}
+		c.responseRead = true
+	}
+	if c.readWaiter != nil {
+		return c.readWaiter.WaitReadBuffer()
+	}
+	return waitReadBuffer(c.Conn, c.readWaitOptions)
+}
+
+// waitReadBuffer reads into a buffer of the options, for streams of protocols without read waiters.
+// Data read together with an error is returned first, and the error by the next read.
+func waitReadBuffer(reader io.Reader, options N.ReadWaitOptions) (buffer *buf.Buffer, err error) {
+	buffer = options.NewBuffer()
+	n, err := buffer.ReadOnceFrom(reader)
+	if n == 0 && err != nil {
+		buffer.Release()
+		return nil, err
+	}
+	options.PostReturn(buffer)
+	return buffer, nil
+}
+
 var _ N.PacketReadWaiter = (*clientPacketConn)(nil)
 
 func (c *clientPacketConn) InitializeReadWaiter(options N.ReadWaitOptions) (needCopy bool) {
@@ -23,13 +63,13 @@ func (c *clientPacketConn) WaitReadPacket() (buffer *buf.Buffer, destination M.S
 		}
 		c.responseRead = true
 	}
-	var length uint16
-	err = binary.Read(c.conn, binary.BigEndian, &length)
+	var length int
+	_, length, err = c.framing.readHeader(c.conn)
 	if err != nil {
 		return
 	}
-	buffer = c.readWaitOptions.NewPacketBuffer()
-	_, err = buffer.ReadFullFrom(c.conn, int(length))
+	buffer = newPacketBuffer(c.readWaitOptions, length)
+	_, err = buffer.ReadFullFrom(c.conn, length)
 	if err != nil {
 		buffer.Release()
 		return nil, M.Socksaddr{}, err
@@ -53,17 +93,13 @@ func (c *clientPacketAddrConn) WaitReadPacket() (buffer *buf.Buffer, destination
 		}
 		c.responseRead = true
 	}
-	destination, err = M.SocksaddrSerializer.ReadAddrPort(c.conn)
-	if err != nil {
-		return
-	}
-	var length uint16
-	err = binary.Read(c.conn, binary.BigEndian, &length)
+	var length int
+	destination, length, err = c.framing.readHeader(c.conn)
 	if err != nil {
 		return
 	}
-	buffer = c.readWaitOptions.NewPacketBuffer()
-	_, err = buffer.ReadFullFrom(c.conn, int(length))
+	buffer = newPacketBuffer(c.readWaitOptions, length)
+	_, err = buffer.ReadFullFrom(c.conn, length)
 	if err != nil {
 		buffer.Release()
 		return nil, M.Socksaddr{}, err
@@ -0,0 +1,77 @@
+package mux
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// HandshakeMode controls when a client stream sends its StreamRequest.
+type HandshakeMode uint8
+
+const (
+	// HandshakeLazy sends the request together with the first write, saving a write for client-speaks-first protocols.
+	HandshakeLazy HandshakeMode = iota
+	// HandshakeEager sends the request as soon as the stream is dialed, so that server-speaks-first protocols,
+	// which read before they write, get a response.
+	HandshakeEager
+	// HandshakeSync sends the request as soon as the stream is dialed, and waits for the response,
+	// so that the failure of the server to reach the destination is returned by DialContext and ListenPacket.
+	HandshakeSync
+)
+
+type handshakeModeKey struct{}
+
+// ContextWithHandshakeMode overrides Options.Handshake for the streams dialed with ctx.
+func ContextWithHandshakeMode(ctx context.Context, mode HandshakeMode) context.Context {
+	return context.WithValue(ctx, handshakeModeKey{}, mode)
+}
+
+func (c *Client) handshakeMode(ctx context.Context) HandshakeMode {
+	if mode, loaded := ctx.Value(handshakeModeKey{}).(HandshakeMode); loaded {
+		return mode
+	}
+	return c.handshake
+}
+
+// handshakeStream sends the request of a dialed stream, and reads the response, as the handshake mode requires.
+func (c *Client) handshakeStream(ctx context.Context, stream net.Conn, writeRequest func() error, readResponse func() error) error {
+	switch c.handshakeMode(ctx) {
+	case HandshakeEager:
+		return writeRequest()
+	case HandshakeSync:
+		err := writeRequest()
+		if err != nil {
+			return err
+		}
+		return waitResponse(ctx, stream, readResponse)
+	default:
+		return nil
+	}
+}
+
+// waitResponse interrupts readResponse if ctx is done first. Closing the stream is not enough for
+// yamux, whose Close only closes the write side, so the read deadline is also set.
+func waitResponse(ctx context.Context, stream net.Conn, readResponse func() error) error {
+	if ctx.Done() == nil {
+		return readResponse()
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			stream.SetReadDeadline(time.Unix(1, 0))
+			stream.Close()
+		case <-done:
+		}
+	}()
+	err := readResponse()
+	close(done)
+	<-stopped
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
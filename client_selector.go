@@ -0,0 +1,211 @@
+package mux
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/atomic"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// Session is the view of a client session exposed to a SessionSelector.
+type Session interface {
+	NumStreams() int
+	CanTakeNewRequest() bool
+	RTT() time.Duration
+	BytesInFlight() int64
+}
+
+// SessionSelector picks the session to open a new stream on.
+// Select receives all live sessions of the client, and returns nil to dial a new session.
+type SessionSelector interface {
+	Select(sessions []Session, destination M.Socksaddr) Session
+}
+
+func availableSessions(sessions []Session) []Session {
+	return common.Filter(sessions, func(it Session) bool {
+		return it.CanTakeNewRequest()
+	})
+}
+
+var _ SessionSelector = (*DefaultSessionSelector)(nil)
+
+// DefaultSessionSelector picks the session with the fewest streams, and dials a new session
+// according to the MaxConnections, MinStreams and MaxStreams rules of Options.
+type DefaultSessionSelector struct {
+	MaxConnections int
+	MinStreams     int
+	MaxStreams     int
+}
+
+func (s *DefaultSessionSelector) Select(sessions []Session, destination M.Socksaddr) Session {
+	session := common.MinBy(availableSessions(sessions), func(it Session) int {
+		return it.NumStreams()
+	})
+	if session == nil {
+		return nil
+	}
+	numStreams := session.NumStreams()
+	if numStreams == 0 {
+		return session
+	}
+	if s.MaxConnections > 0 {
+		if len(sessions) >= s.MaxConnections || numStreams < s.MinStreams {
+			return session
+		}
+	} else {
+		if s.MaxStreams > 0 && numStreams < s.MaxStreams {
+			return session
+		}
+	}
+	return nil
+}
+
+type brutalSessionSelector struct{}
+
+func (s *brutalSessionSelector) Select(sessions []Session, destination M.Socksaddr) Session {
+	sessions = availableSessions(sessions)
+	if len(sessions) > 0 {
+		return sessions[0]
+	}
+	return nil
+}
+
+var _ SessionSelector = (*RoundRobinSessionSelector)(nil)
+
+// RoundRobinSessionSelector dials up to MaxConnections sessions, then rotates between them.
+type RoundRobinSessionSelector struct {
+	MaxConnections int
+	index          atomic.Uint32
+}
+
+func (s *RoundRobinSessionSelector) Select(sessions []Session, destination M.Socksaddr) Session {
+	sessions = availableSessions(sessions)
+	if len(sessions) == 0 || len(sessions) < s.MaxConnections {
+		return nil
+	}
+	return sessions[int(s.index.Add(1)-1)%len(sessions)]
+}
+
+var _ SessionSelector = (*LeastRTTSessionSelector)(nil)
+
+// LeastRTTSessionSelector dials up to MaxConnections sessions, then picks the one with the lowest ping RTT.
+// RTTs are only measured when Options.HealthCheck is enabled, and sessions without one are picked last.
+type LeastRTTSessionSelector struct {
+	MaxConnections int
+}
+
+func (s *LeastRTTSessionSelector) Select(sessions []Session, destination M.Socksaddr) Session {
+	sessions = availableSessions(sessions)
+	if len(sessions) == 0 || len(sessions) < s.MaxConnections {
+		return nil
+	}
+	return common.MinBy(sessions, func(it Session) time.Duration {
+		rtt := it.RTT()
+		if rtt == 0 {
+			return math.MaxInt64
+		}
+		return rtt
+	})
+}
+
+var _ SessionSelector = (*LeastBytesInFlightSessionSelector)(nil)
+
+// LeastBytesInFlightSessionSelector dials up to MaxConnections sessions, then picks the one
+// with the fewest bytes pending in stream writes.
+type LeastBytesInFlightSessionSelector struct {
+	MaxConnections int
+}
+
+func (s *LeastBytesInFlightSessionSelector) Select(sessions []Session, destination M.Socksaddr) Session {
+	sessions = availableSessions(sessions)
+	if len(sessions) == 0 || len(sessions) < s.MaxConnections {
+		return nil
+	}
+	return common.MinBy(sessions, func(it Session) int64 {
+		return it.BytesInFlight()
+	})
+}
+
+var _ SessionSelector = (*DestinationHashSessionSelector)(nil)
+
+// DestinationHashSessionSelector maps each destination to one of MaxConnections session slots,
+// so streams to the same destination share a session while it lives. A slot keeps its session until it
+// closes or stops taking new streams, and is then refilled by a new session, leaving other slots untouched.
+// If a slot has no session and no new one can be dialed, the session of the next slot is picked.
+type DestinationHashSessionSelector struct {
+	MaxConnections int
+	access         sync.Mutex
+	slots          []Session
+	// pendingSlot is the slot plus one of the last session dialed, zero if none.
+	pendingSlot int
+}
+
+func (s *DestinationHashSessionSelector) Select(sessions []Session, destination M.Socksaddr) Session {
+	maxConnections := s.MaxConnections
+	if maxConnections <= 0 {
+		maxConnections = 1
+	}
+	s.access.Lock()
+	defer s.access.Unlock()
+	if len(s.slots) != maxConnections {
+		s.slots = make([]Session, maxConnections)
+		s.pendingSlot = 0
+	}
+	s.assignSlots(sessions)
+	hash := fnv.New32a()
+	hash.Write([]byte(destination.String()))
+	index := int(hash.Sum32() % uint32(maxConnections))
+	if s.slots[index] != nil {
+		return s.slots[index]
+	}
+	if len(sessions) < maxConnections {
+		s.pendingSlot = index + 1
+		return nil
+	}
+	for i := 1; i < maxConnections; i++ {
+		session := s.slots[(index+i)%maxConnections]
+		if session != nil {
+			return session
+		}
+	}
+	return nil
+}
+
+// assignSlots releases the slots of sessions that are closed or can not take new streams,
+// and assigns new sessions to free slots, the session dialed for a slot to that slot.
+func (s *DestinationHashSessionSelector) assignSlots(sessions []Session) {
+	for i, session := range s.slots {
+		if session == nil {
+			continue
+		}
+		if !session.CanTakeNewRequest() || !common.Any(sessions, func(it Session) bool {
+			return it == session
+		}) {
+			s.slots[i] = nil
+		}
+	}
+	for _, session := range sessions {
+		if !session.CanTakeNewRequest() || common.Any(s.slots, func(it Session) bool {
+			return it == session
+		}) {
+			continue
+		}
+		var index int
+		if s.pendingSlot > 0 && s.slots[s.pendingSlot-1] == nil {
+			index = s.pendingSlot - 1
+		} else {
+			index = common.Index(s.slots, func(it Session) bool {
+				return it == nil
+			})
+		}
+		s.pendingSlot = 0
+		if index == -1 {
+			return
+		}
+		s.slots[index] = session
+	}
+}
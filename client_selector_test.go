@@ -0,0 +1,68 @@
+package mux
+
+import (
+	"testing"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+type testSession struct {
+	draining bool
+}
+
+func (s *testSession) NumStreams() int         { return 0 }
+func (s *testSession) CanTakeNewRequest() bool { return !s.draining }
+func (s *testSession) RTT() time.Duration      { return 0 }
+func (s *testSession) BytesInFlight() int64    { return 0 }
+
+// selectTestSession dials a new session when the selector returns nil, as Client does.
+func selectTestSession(selector SessionSelector, sessions *[]Session, destination M.Socksaddr) Session {
+	session := selector.Select(*sessions, destination)
+	if session == nil {
+		session = &testSession{}
+		*sessions = append(*sessions, session)
+	}
+	return session
+}
+
+func TestDestinationHashSessionSelector(t *testing.T) {
+	selector := &DestinationHashSessionSelector{MaxConnections: 4}
+	var (
+		sessions     []Session
+		destinations []M.Socksaddr
+	)
+	for port := uint16(1); port <= 64; port++ {
+		destinations = append(destinations, M.ParseSocksaddrHostPort("example.com", port))
+	}
+	selected := make(map[M.Socksaddr]Session)
+	for _, destination := range destinations {
+		selected[destination] = selectTestSession(selector, &sessions, destination)
+	}
+	if len(sessions) != 4 {
+		t.Fatal("unexpected session count: ", len(sessions))
+	}
+	for _, destination := range destinations {
+		if selectTestSession(selector, &sessions, destination) != selected[destination] {
+			t.Fatal("unstable session of ", destination)
+		}
+	}
+	removed := sessions[1]
+	sessions = append(sessions[:1:1], sessions[2:]...)
+	sessions[0].(*testSession).draining = true
+	drained := sessions[0]
+	for _, destination := range destinations {
+		session := selectTestSession(selector, &sessions, destination)
+		previous := selected[destination]
+		if previous != removed && previous != drained && session != previous {
+			t.Fatal("session of ", destination, " moved after another session closed")
+		}
+		if session == removed || session == drained {
+			t.Fatal("picked closed or draining session for ", destination)
+		}
+	}
+	// the closed session is replaced, and the draining one still counts towards MaxConnections
+	if len(sessions) != 4 {
+		t.Fatal("unexpected session count: ", len(sessions))
+	}
+}
@@ -0,0 +1,137 @@
+package mux
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/atomic"
+)
+
+var _ Session = (*clientSession)(nil)
+
+type clientSession struct {
+	abstractSession
+	client    *Client
+	stats     *sessionStats
+	rtt       atomic.Int64
+	inFlight  atomic.Int64
+	streams   atomic.Int64
+	draining  atomic.Bool
+	ageTimer  *time.Timer
+	closeOnce sync.Once
+}
+
+// RTT returns the round-trip time measured by the last successful ping.
+func (s *clientSession) RTT() time.Duration {
+	return time.Duration(s.rtt.Load())
+}
+
+func (s *clientSession) BytesInFlight() int64 {
+	return s.inFlight.Load()
+}
+
+func (s *clientSession) CanTakeNewRequest() bool {
+	return !s.draining.Load() && s.abstractSession.CanTakeNewRequest()
+}
+
+// Open counts streams until their close, as protocols may only count a new stream once the peer has seen it,
+// which would let a draining session close under it.
+func (s *clientSession) Open() (net.Conn, error) {
+	s.streams.Add(1)
+	stream, err := s.abstractSession.Open()
+	if err != nil {
+		s.streams.Add(-1)
+		s.closeIfDrained()
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *clientSession) Close() error {
+	return s.closeWithError(nil)
+}
+
+func (s *clientSession) closeWithError(err error) error {
+	s.closeOnce.Do(func() {
+		if s.ageTimer != nil {
+			s.ageTimer.Stop()
+		}
+		s.client.tracer.sessionClosed(err)
+	})
+	return s.abstractSession.Close()
+}
+
+func (s *clientSession) onStreamOpened() {
+	maxStreams := s.client.maxStreamCount
+	if maxStreams > 0 && s.stats.streamsOpened.Load() >= uint64(maxStreams) {
+		s.drain()
+	}
+}
+
+func (s *clientSession) onBytesTransferred() {
+	maxBytes := s.client.maxBytes
+	if maxBytes > 0 && s.stats.upload.Load()+s.stats.download.Load() >= maxBytes {
+		s.drain()
+	}
+}
+
+// drain stops the session from taking new streams, and closes it once idle.
+func (s *clientSession) drain() {
+	if s.draining.Swap(true) {
+		return
+	}
+	s.closeIfDrained()
+}
+
+func (s *clientSession) closeIfDrained() {
+	if s.draining.Load() && !s.IsClosed() && s.streams.Load() == 0 {
+		s.Close()
+		s.client.notifyMaintainer()
+	}
+}
+
+// drainGoingAway drains the session of stream once the service rejects the stream as going away.
+func drainGoingAway(stream net.Conn, err error) {
+	if !errors.Is(err, ErrRemoteGoingAway) {
+		return
+	}
+	if stream, isClientStream := common.Cast[*clientStream](stream); isClientStream {
+		stream.session.drain()
+	}
+}
+
+type clientStream struct {
+	net.Conn
+	session *clientSession
+	closed  atomic.Bool
+}
+
+func (c *clientStream) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	c.session.onBytesTransferred()
+	return
+}
+
+func (c *clientStream) Write(p []byte) (n int, err error) {
+	c.session.inFlight.Add(int64(len(p)))
+	n, err = c.Conn.Write(p)
+	c.session.inFlight.Add(-int64(len(p)))
+	c.session.onBytesTransferred()
+	return
+}
+
+func (c *clientStream) Close() error {
+	err := c.Conn.Close()
+	if !c.closed.Swap(true) {
+		c.session.streams.Add(-1)
+		c.session.closeIfDrained()
+	}
+	return err
+}
+
+func (c *clientStream) Upstream() any {
+	return c.Conn
+}
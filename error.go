@@ -31,6 +31,8 @@ func wrapError(err error) error {
 	switch err {
 	case yamux.ErrStreamClosed:
 		return io.EOF
+	case yamux.ErrConnectionReset:
+		return &StreamResetError{Code: ErrorCodeGeneral}
 	default:
 		return err
 	}
@@ -0,0 +1,197 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// ErrorCode tells why the server failed to open a stream.
+// It is only sent to clients that set ErrorCodes in the StreamRequest.
+type ErrorCode uint8
+
+const (
+	ErrorCodeGeneral ErrorCode = iota
+	ErrorCodeConnectionRefused
+	ErrorCodeHostUnreachable
+	ErrorCodeNetworkUnreachable
+	ErrorCodeDNSFailure
+	ErrorCodeRejected
+	ErrorCodeTimeout
+	ErrorCodeConnectionReset
+	// ErrorCodeGoingAway rejects streams of a session that is shutting down,
+	// and makes the client stop opening streams on it.
+	ErrorCodeGoingAway
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrorCodeGeneral:
+		return "general failure"
+	case ErrorCodeConnectionRefused:
+		return "connection refused"
+	case ErrorCodeHostUnreachable:
+		return "host unreachable"
+	case ErrorCodeNetworkUnreachable:
+		return "network unreachable"
+	case ErrorCodeDNSFailure:
+		return "dns failure"
+	case ErrorCodeRejected:
+		return "rejected"
+	case ErrorCodeTimeout:
+		return "timeout"
+	case ErrorCodeConnectionReset:
+		return "connection reset"
+	case ErrorCodeGoingAway:
+		return "going away"
+	default:
+		return "unknown error code"
+	}
+}
+
+type codedError struct {
+	code ErrorCode
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// WithErrorCode makes err reported to the client with code, instead of the code derived from err.
+// Handlers may use it to report policy rejections with ErrorCodeRejected.
+func WithErrorCode(err error, code ErrorCode) error {
+	return &codedError{code, err}
+}
+
+func errorCodeOf(err error) ErrorCode {
+	var (
+		codedErr  *codedError
+		remoteErr *RemoteError
+		dnsErr    *net.DNSError
+	)
+	switch {
+	case errors.As(err, &codedErr):
+		return codedErr.code
+	case errors.As(err, &remoteErr):
+		// relay the code of a chained server
+		return remoteErr.Code
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorCodeConnectionRefused
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return ErrorCodeHostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ErrorCodeNetworkUnreachable
+	case errors.Is(err, syscall.ECONNRESET):
+		return ErrorCodeConnectionReset
+	case errors.As(err, &dnsErr):
+		return ErrorCodeDNSFailure
+	case E.IsTimeout(err) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, syscall.ETIMEDOUT):
+		return ErrorCodeTimeout
+	default:
+		return ErrorCodeGeneral
+	}
+}
+
+var (
+	// ErrRemote matches every RemoteError.
+	ErrRemote                   = E.New("remote error")
+	ErrRemoteConnectionRefused  = E.New("remote error: connection refused")
+	ErrRemoteHostUnreachable    = E.New("remote error: host unreachable")
+	ErrRemoteNetworkUnreachable = E.New("remote error: network unreachable")
+	ErrRemoteDNSFailure         = E.New("remote error: dns failure")
+	ErrRemoteRejected           = E.New("remote error: rejected")
+	ErrRemoteTimeout            = E.New("remote error: timeout")
+	ErrRemoteConnectionReset    = E.New("remote error: connection reset")
+	ErrRemoteGoingAway          = E.New("remote error: going away")
+)
+
+// RemoteError is returned by client streams when the server fails to open the stream,
+// and by ReadBrutalResponse when the server refuses TCP Brutal.
+// It matches ErrRemote and the ErrRemote sentinel of its code with errors.Is,
+// and unwraps to the local error matching its code, such as syscall.ECONNREFUSED.
+type RemoteError struct {
+	// Code is ErrorCodeGeneral if the server does not support error codes.
+	Code    ErrorCode
+	Message string
+	// Destination is the destination of the stream, if any.
+	Destination M.Socksaddr
+}
+
+func (e *RemoteError) Error() string {
+	return "remote error: " + e.Message
+}
+
+func (e *RemoteError) Is(target error) bool {
+	switch target {
+	case ErrRemote:
+		return true
+	case ErrRemoteConnectionRefused:
+		return e.Code == ErrorCodeConnectionRefused
+	case ErrRemoteHostUnreachable:
+		return e.Code == ErrorCodeHostUnreachable
+	case ErrRemoteNetworkUnreachable:
+		return e.Code == ErrorCodeNetworkUnreachable
+	case ErrRemoteDNSFailure:
+		return e.Code == ErrorCodeDNSFailure
+	case ErrRemoteRejected:
+		return e.Code == ErrorCodeRejected
+	case ErrRemoteTimeout:
+		return e.Code == ErrorCodeTimeout
+	case ErrRemoteConnectionReset:
+		return e.Code == ErrorCodeConnectionReset
+	case ErrRemoteGoingAway:
+		return e.Code == ErrorCodeGoingAway
+	default:
+		return false
+	}
+}
+
+func (e *RemoteError) Unwrap() error {
+	switch e.Code {
+	case ErrorCodeConnectionRefused:
+		return syscall.ECONNREFUSED
+	case ErrorCodeHostUnreachable:
+		return syscall.EHOSTUNREACH
+	case ErrorCodeNetworkUnreachable:
+		return syscall.ENETUNREACH
+	case ErrorCodeDNSFailure:
+		return &net.DNSError{Err: e.Message, Name: e.Destination.Fqdn}
+	case ErrorCodeTimeout:
+		return os.ErrDeadlineExceeded
+	case ErrorCodeConnectionReset:
+		return syscall.ECONNRESET
+	default:
+		return nil
+	}
+}
+
+func streamResponseError(response *StreamResponse, destination M.Socksaddr) error {
+	switch response.Status {
+	case statusSuccess:
+		return nil
+	case statusError:
+		return &RemoteError{Code: ErrorCodeGeneral, Message: response.Message, Destination: destination}
+	default:
+		return &RemoteError{Code: response.Code, Message: response.Message, Destination: destination}
+	}
+}
+
+// readResponseError reports streams reset before their response, as services refuse streams over their limits,
+// as a RemoteError with the code of the reset.
+func readResponseError(err error, destination M.Socksaddr) error {
+	var resetErr *StreamResetError
+	if errors.As(err, &resetErr) {
+		return &RemoteError{Code: resetErr.Code, Message: resetErr.Error(), Destination: destination}
+	}
+	return err
+}
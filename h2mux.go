@@ -3,7 +3,6 @@ package mux
 import (
 	"context"
 	"crypto/tls"
-	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -11,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/atomic"
 	"github.com/sagernet/sing/common/buf"
 	"github.com/sagernet/sing/common/bufio"
@@ -26,6 +26,7 @@ var _ abstractSession = (*h2MuxServerSession)(nil)
 
 type h2MuxServerSession struct {
 	server  http2.Server
+	base    http.Server
 	active  atomic.Int32
 	conn    net.Conn
 	inbound chan net.Conn
@@ -42,9 +43,12 @@ func newH2MuxServer(conn net.Conn) *h2MuxServerSession {
 			MaxReadFrameSize: buf.BufferSize,
 		},
 	}
+	// registers the graceful shutdown hook used to send GOAWAY
+	common.Must(http2.ConfigureServer(&session.base, &session.server))
 	go func() {
 		session.server.ServeConn(conn, &http2.ServeConnOpts{
-			Handler: session,
+			BaseConfig: &session.base,
+			Handler:    session,
 		})
 		_ = session.Close()
 	}()
@@ -55,7 +59,7 @@ func (s *h2MuxServerSession) ServeHTTP(writer http.ResponseWriter, request *http
 	s.active.Add(1)
 	defer s.active.Add(-1)
 	writer.WriteHeader(http.StatusOK)
-	conn := newHTTP2Wrapper(newHTTPConn(request.Body, writer), writer.(http.Flusher))
+	conn := newHTTP2Wrapper(newHTTPConn(request.Body, writer, s.conn), writer.(http.Flusher))
 	s.inbound <- conn
 	select {
 	case <-conn.done:
@@ -103,6 +107,14 @@ func (s *h2MuxServerSession) CanTakeNewRequest() bool {
 	return false
 }
 
+func (s *h2MuxServerSession) Ping() (time.Duration, error) {
+	return 0, os.ErrInvalid
+}
+
+func (s *h2MuxServerSession) Shutdown() error {
+	return s.base.Shutdown(context.Background())
+}
+
 type h2MuxConnWrapper struct {
 	N.ExtendedConn
 	flusher http.Flusher
@@ -145,7 +157,9 @@ func (w *h2MuxConnWrapper) WriteBuffer(buffer *buf.Buffer) error {
 	return err
 }
 
+// Close closes the stream before the handler returns, after which the deadlines of the response writer must not be set.
 func (w *h2MuxConnWrapper) Close() error {
+	err := w.ExtendedConn.Close()
 	w.access.Lock()
 	select {
 	case <-w.done:
@@ -154,7 +168,7 @@ func (w *h2MuxConnWrapper) Close() error {
 	}
 	w.closed = true
 	w.access.Unlock()
-	return w.ExtendedConn.Close()
+	return err
 }
 
 func (w *h2MuxConnWrapper) Upstream() any {
@@ -165,9 +179,13 @@ var _ abstractSession = (*h2MuxClientSession)(nil)
 
 type h2MuxClientSession struct {
 	transport  *http2.Transport
+	conn       net.Conn
 	clientConn *http2.ClientConn
 	access     sync.RWMutex
 	closed     bool
+	// ctx bounds the graceful shutdown to the lifetime of the session.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func newH2MuxClient(conn net.Conn) (*h2MuxClientSession, error) {
@@ -179,10 +197,13 @@ func newH2MuxClient(conn net.Conn) (*h2MuxClientSession, error) {
 			ReadIdleTimeout:  idleTimeout,
 			MaxReadFrameSize: buf.BufferSize,
 		},
+		conn: conn,
 	}
+	session.ctx, session.cancel = context.WithCancel(context.Background())
 	session.transport.ConnPool = session
 	clientConn, err := session.transport.NewClientConn(conn)
 	if err != nil {
+		session.cancel()
 		return nil, err
 	}
 	session.clientConn = clientConn
@@ -193,20 +214,21 @@ func (s *h2MuxClientSession) GetClientConn(req *http.Request, addr string) (*htt
 	return s.clientConn, nil
 }
 
+// MarkDead is also called when GOAWAY is received, where running streams must be left to finish,
+// so dead connections are detected through State instead.
 func (s *h2MuxClientSession) MarkDead(conn *http2.ClientConn) {
-	s.Close()
 }
 
 func (s *h2MuxClientSession) Open() (net.Conn, error) {
-	pipeInReader, pipeInWriter := io.Pipe()
+	requestBody := newHTTPRequestBody()
 	request := &http.Request{
 		Method: http.MethodConnect,
-		Body:   pipeInReader,
+		Body:   requestBody,
 		URL:    &url.URL{Scheme: "https", Host: "localhost"},
 	}
 	connCtx, cancel := context.WithCancel(context.Background())
 	request = request.WithContext(connCtx)
-	conn := newLateHTTPConn(pipeInWriter, cancel)
+	conn := newLateHTTPConn(requestBody, cancel, s.conn)
 	requestDone := make(chan struct{})
 	go func() {
 		select {
@@ -228,7 +250,7 @@ func (s *h2MuxClientSession) Open() (net.Conn, error) {
 			conn.setup(response.Body, nil)
 		}
 	}()
-	return conn, nil
+	return &httpClientConn{conn}, nil
 }
 
 func (s *h2MuxClientSession) Accept() (net.Conn, error) {
@@ -246,6 +268,7 @@ func (s *h2MuxClientSession) Close() error {
 		return os.ErrClosed
 	}
 	s.closed = true
+	s.cancel()
 	return s.clientConn.Close()
 }
 
@@ -253,9 +276,26 @@ func (s *h2MuxClientSession) IsClosed() bool {
 	s.access.RLock()
 	defer s.access.RUnlock()
 	state := s.clientConn.State()
-	return s.closed || state.Closed || state.Closing
+	return s.closed || state.Closed || state.Closing && state.StreamsActive == 0
 }
 
 func (s *h2MuxClientSession) CanTakeNewRequest() bool {
 	return s.clientConn.CanTakeNewRequest()
 }
+
+func (s *h2MuxClientSession) Ping() (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), TCPTimeout)
+	defer cancel()
+	start := time.Now()
+	err := s.clientConn.Ping(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// Shutdown sends GOAWAY, and closes the session once its streams are done, unless it is closed before.
+func (s *h2MuxClientSession) Shutdown() error {
+	go s.clientConn.Shutdown(s.ctx)
+	return nil
+}
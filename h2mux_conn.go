@@ -2,88 +2,362 @@ package mux
 
 import (
 	"context"
+	"errors"
 	"io"
+	"math"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/baderror"
-	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/common/bufio/deadline"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/pipe"
+
+	"golang.org/x/net/http2"
 )
 
+// httpDeadlineSetter is implemented by the http.ResponseWriter of the http2 server,
+// which resets the stream when a deadline is exceeded.
+type httpDeadlineSetter interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+var _ streamResetter = (*httpConn)(nil)
+
+// h2muxResetCodeBase is added to the ErrorCode of resets of clients, to carry it in the RST_STREAM error code
+// beyond the http2 ones. Peers not knowing it take it as an unknown http2 error code.
+const h2muxResetCodeBase http2.ErrCode = 0x100
+
+// httpConn is the stream of a CONNECT request.
+// As with the http2 server, an exceeded deadline of server streams resets the stream, so it can not be extended afterwards.
+// The deadlines of client streams only interrupt pending reads and writes.
 type httpConn struct {
-	reader io.Reader
-	writer io.Writer
-	create chan struct{}
-	err    error
-	cancel context.CancelFunc
+	reader     io.Reader
+	writer     io.Writer
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	// create is closed once the response of client streams is received, with response or err.
+	create      chan struct{}
+	response    io.ReadCloser
+	err         error
+	cancel      context.CancelFunc
+	access      sync.Mutex
+	closed      bool
+	writeClosed bool
+	resetting   bool
+	// writeTimeout is the write deadline of server streams, whose writes fail with a stream error when it is exceeded.
+	writeTimeout time.Time
 }
 
-func newHTTPConn(reader io.Reader, writer io.Writer) *httpConn {
+// sessionConn is the connection carrying the session, whose addresses are reported by the stream.
+func newHTTPConn(reader io.Reader, writer io.Writer, sessionConn net.Conn) *httpConn {
 	return &httpConn{
-		reader: reader,
-		writer: writer,
+		reader:     reader,
+		writer:     writer,
+		localAddr:  sessionConn.LocalAddr(),
+		remoteAddr: sessionConn.RemoteAddr(),
 	}
 }
 
-func newLateHTTPConn(writer io.Writer, cancel context.CancelFunc) *httpConn {
-	return &httpConn{
-		create: make(chan struct{}),
-		writer: writer,
-		cancel: cancel,
+func newLateHTTPConn(requestBody *httpRequestBody, cancel context.CancelFunc, sessionConn net.Conn) *httpConn {
+	conn := &httpConn{
+		create:     make(chan struct{}),
+		writer:     requestBody,
+		localAddr:  sessionConn.LocalAddr(),
+		remoteAddr: sessionConn.RemoteAddr(),
+		cancel:     cancel,
 	}
+	conn.reader = deadline.NewReader(&httpResponseReader{conn})
+	return conn
 }
 
-func (c *httpConn) setup(reader io.Reader, err error) {
-	c.reader = reader
+func (c *httpConn) setup(response io.ReadCloser, err error) {
+	c.response = response
 	c.err = err
 	close(c.create)
 }
 
+// closeResponse waits for the response, which is received soon once the request is cancelled or reset, and closes it.
+func (c *httpConn) closeResponse() {
+	<-c.create
+	if c.response != nil {
+		c.response.Close()
+	}
+}
+
 func (c *httpConn) Read(b []byte) (n int, err error) {
-	if c.reader == nil {
-		<-c.create
-		if c.err != nil {
-			return 0, c.err
+	n, err = c.reader.Read(b)
+	if err != nil {
+		err = c.wrapReadError(err)
+	}
+	return
+}
+
+// wrapReadError reports RST_STREAM frames of the peer, except for the CANCEL sent by Close, as StreamResetError,
+// with the ErrorCode of resets of clients.
+func (c *httpConn) wrapReadError(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return os.ErrDeadlineExceeded
+	}
+	c.access.Lock()
+	resetting := c.resetting
+	c.access.Unlock()
+	if resetting {
+		return net.ErrClosed
+	}
+	var streamErr http2.StreamError
+	if errors.As(err, &streamErr) {
+		switch {
+		case streamErr.Cause == os.ErrDeadlineExceeded:
+			return os.ErrDeadlineExceeded
+		case streamErr.Code >= h2muxResetCodeBase && streamErr.Code-h2muxResetCodeBase <= math.MaxUint8:
+			return &StreamResetError{Code: ErrorCode(streamErr.Code - h2muxResetCodeBase)}
+		case streamErr.Code != http2.ErrCodeCancel:
+			return &StreamResetError{Code: ErrorCodeGeneral}
 		}
 	}
-	n, err = c.reader.Read(b)
-	return n, baderror.WrapH2(err)
+	return baderror.WrapH2(err)
 }
 
 func (c *httpConn) Write(b []byte) (n int, err error) {
 	n, err = c.writer.Write(b)
+	if err != nil && c.writeTimedOut() {
+		return n, os.ErrDeadlineExceeded
+	}
 	return n, baderror.WrapH2(err)
 }
 
 func (c *httpConn) Close() error {
-	if c.cancel != nil {
-		c.cancel()
+	c.access.Lock()
+	c.closed = true
+	resetting := c.resetting
+	c.access.Unlock()
+	requestBody, isClient := c.writer.(*httpRequestBody)
+	if !isClient {
+		return common.Close(c.reader, c.writer)
+	}
+	if resetting {
+		// cancelling the request, or closing the response body, would send CANCEL before the transport
+		// resets the stream with the error of the request body, so both wait until the transport is done with it.
+		go func() {
+			select {
+			case <-requestBody.readerDone:
+			case <-time.After(TCPTimeout):
+				c.cancel()
+			}
+			c.closeResponse()
+			c.cancel()
+		}()
+		return nil
+	}
+	c.cancel()
+	c.closeResponse()
+	return requestBody.CloseWithError(nil)
+}
+
+var _ N.WriteCloser = (*httpClientConn)(nil)
+
+// httpClientConn is the stream of a client, which can end the request body while reading the response.
+type httpClientConn struct {
+	*httpConn
+}
+
+// CloseWrite ends the request body with END_STREAM.
+func (c *httpClientConn) CloseWrite() error {
+	c.access.Lock()
+	c.writeClosed = true
+	c.access.Unlock()
+	return c.writer.(*httpRequestBody).CloseWithError(nil)
+}
+
+// reset sends RST_STREAM, as CANCEL is sent by Close. Client streams fail the request body with a stream error
+// carrying code, which the transport sends as the reset. The http2 server can not send error codes of its own,
+// so server streams exceed the write deadline instead, which resets the stream with INTERNAL_ERROR.
+func (c *httpConn) reset(code ErrorCode) error {
+	c.access.Lock()
+	if c.closed || c.resetting {
+		c.access.Unlock()
+		return nil
+	}
+	c.resetting = true
+	writeClosed := c.writeClosed
+	c.access.Unlock()
+	switch writer := c.writer.(type) {
+	case *httpRequestBody:
+		if writeClosed {
+			// the transport no longer reads the request body
+			c.cancel()
+			return nil
+		}
+		return writer.CloseWithError(http2.StreamError{Code: h2muxResetCodeBase + http2.ErrCode(code)})
+	case httpDeadlineSetter:
+		return writer.SetWriteDeadline(time.Unix(1, 0))
+	default:
+		return nil
 	}
-	return common.Close(c.reader, c.writer)
 }
 
 func (c *httpConn) LocalAddr() net.Addr {
-	return M.Socksaddr{}
+	return c.localAddr
 }
 
 func (c *httpConn) RemoteAddr() net.Addr {
-	return M.Socksaddr{}
+	return c.remoteAddr
 }
 
 func (c *httpConn) SetDeadline(t time.Time) error {
-	return os.ErrInvalid
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
 }
 
 func (c *httpConn) SetReadDeadline(t time.Time) error {
-	return os.ErrInvalid
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if setter, isSetter := c.writer.(httpDeadlineSetter); isSetter {
+		return setter.SetReadDeadline(t)
+	}
+	return c.reader.(deadline.TimeoutReader).SetReadDeadline(t)
 }
 
 func (c *httpConn) SetWriteDeadline(t time.Time) error {
-	return os.ErrInvalid
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if setter, isSetter := c.writer.(httpDeadlineSetter); isSetter {
+		c.writeTimeout = t
+		return setter.SetWriteDeadline(t)
+	}
+	c.writer.(*httpRequestBody).writeDeadline.Set(t)
+	return nil
+}
+
+func (c *httpConn) writeTimedOut() bool {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return !c.writeTimeout.IsZero() && !time.Now().Before(c.writeTimeout)
 }
 
 func (c *httpConn) NeedAdditionalReadDeadline() bool {
 	return true
 }
+
+// httpResponseReader reads the response of a client stream once it is received.
+// The deadline reader wrapping it handles the read deadline.
+type httpResponseReader struct {
+	conn *httpConn
+}
+
+func (r *httpResponseReader) Read(p []byte) (n int, err error) {
+	<-r.conn.create
+	if r.conn.err != nil {
+		return 0, r.conn.err
+	}
+	return r.conn.response.Read(p)
+}
+
+func (r *httpResponseReader) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// httpRequestBody is the request body of a client stream, a pipe to the transport like io.Pipe,
+// except that an exceeded write deadline only interrupts the pending write.
+type httpRequestBody struct {
+	writeAccess   sync.Mutex
+	data          chan []byte
+	consumed      chan int
+	writerOnce    sync.Once
+	writerDone    chan struct{}
+	writerErr     error
+	readerOnce    sync.Once
+	readerDone    chan struct{}
+	writeDeadline pipe.Deadline
+}
+
+func newHTTPRequestBody() *httpRequestBody {
+	return &httpRequestBody{
+		data:          make(chan []byte),
+		consumed:      make(chan int),
+		writerDone:    make(chan struct{}),
+		readerDone:    make(chan struct{}),
+		writeDeadline: pipe.MakeDeadline(),
+	}
+}
+
+func (b *httpRequestBody) Read(p []byte) (n int, err error) {
+	select {
+	case <-b.readerDone:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	select {
+	case data := <-b.data:
+		n = copy(p, data)
+		b.consumed <- n
+		return n, nil
+	case <-b.writerDone:
+		return 0, b.writerErr
+	case <-b.readerDone:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+// Close is called by the transport once it is done with the request body.
+func (b *httpRequestBody) Close() error {
+	b.readerOnce.Do(func() {
+		close(b.readerDone)
+	})
+	return nil
+}
+
+func (b *httpRequestBody) Write(p []byte) (n int, err error) {
+	select {
+	case <-b.writerDone:
+		return 0, io.ErrClosedPipe
+	case <-b.readerDone:
+		return 0, io.ErrClosedPipe
+	case <-b.writeDeadline.Wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+	b.writeAccess.Lock()
+	defer b.writeAccess.Unlock()
+	for once := true; once || len(p) > 0; once = false {
+		select {
+		case b.data <- p:
+			consumed := <-b.consumed
+			p = p[consumed:]
+			n += consumed
+		case <-b.writerDone:
+			return n, io.ErrClosedPipe
+		case <-b.readerDone:
+			return n, io.ErrClosedPipe
+		case <-b.writeDeadline.Wait():
+			return n, os.ErrDeadlineExceeded
+		}
+	}
+	return n, nil
+}
+
+// CloseWithError makes the transport read err, or io.EOF if it is nil, after the written data.
+func (b *httpRequestBody) CloseWithError(err error) error {
+	if err == nil {
+		err = io.EOF
+	}
+	b.writerOnce.Do(func() {
+		b.writerErr = err
+		close(b.writerDone)
+	})
+	return nil
+}
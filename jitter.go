@@ -0,0 +1,300 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// JitterOptions obfuscates the timing of session writes: writes are queued, and released
+// in batches of up to Burst writes, each batch after a delay drawn from [MinDelay, MaxDelay].
+// The client announces its options in the request, and the server schedules its writes with the same options.
+type JitterOptions struct {
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// Burst defaults to 1.
+	Burst int
+}
+
+// DefaultMaxJitterDelay is the default bound of the delay of the writes of services.
+const DefaultMaxJitterDelay = 100 * time.Millisecond
+
+func (o *JitterOptions) Validate() error {
+	if o.MinDelay < 0 || o.MinDelay > o.MaxDelay || o.MaxDelay.Milliseconds() > math.MaxUint16 {
+		return E.New("invalid jitter delay: ", o.MinDelay, "-", o.MaxDelay)
+	}
+	if o.Burst < 0 || o.Burst > math.MaxUint16 {
+		return E.New("invalid jitter burst: ", o.Burst)
+	}
+	return nil
+}
+
+// encoded as minDelay(2, ms) + maxDelay(2, ms) + burst(2)
+const jitterOptionsLen = 6
+
+func (o *JitterOptions) writeTo(buffer *buf.Buffer) {
+	common.Must(
+		binary.Write(buffer, binary.BigEndian, uint16(o.MinDelay.Milliseconds())),
+		binary.Write(buffer, binary.BigEndian, uint16(o.MaxDelay.Milliseconds())),
+		binary.Write(buffer, binary.BigEndian, uint16(o.Burst)),
+	)
+}
+
+func readJitterOptions(reader io.Reader) (*JitterOptions, error) {
+	var encoded struct {
+		MinDelay uint16
+		MaxDelay uint16
+		Burst    uint16
+	}
+	err := binary.Read(reader, binary.BigEndian, &encoded)
+	if err != nil {
+		return nil, err
+	}
+	options := &JitterOptions{
+		MinDelay: time.Duration(encoded.MinDelay) * time.Millisecond,
+		MaxDelay: time.Duration(encoded.MaxDelay) * time.Millisecond,
+		Burst:    int(encoded.Burst),
+	}
+	err = options.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+func (o *JitterOptions) delay() time.Duration {
+	return o.MinDelay + time.Duration(rand.Int63n(int64(o.MaxDelay-o.MinDelay)+1))
+}
+
+// jitterQueueLimit is the size of queued writes above which Write blocks.
+const jitterQueueLimit = 1024 * 1024
+
+var _ N.VectorisedWriter = (*jitterConn)(nil)
+
+// jitterConn applies write deadlines to queuing writes only: a write fails once its deadline is exceeded
+// while the queue is full, and queued writes are sent regardless of deadlines.
+type jitterConn struct {
+	net.Conn
+	writer        N.VectorisedWriter
+	options       *JitterOptions
+	access        sync.Mutex
+	queueUpdate   *sync.Cond
+	queue         [][]*buf.Buffer
+	queuedBytes   int
+	writeDeadline time.Time
+	deadlineTimer *time.Timer
+	closed        bool
+	err           error
+	notify        chan struct{}
+	done          chan struct{}
+	writeAccess   sync.Mutex
+}
+
+// newJitterConn keeps vectorised writes vectorised when conn supports them.
+func newJitterConn(conn net.Conn, options *JitterOptions) net.Conn {
+	c := &jitterConn{
+		Conn:    conn,
+		options: options,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	c.queueUpdate = sync.NewCond(&c.access)
+	writer, isVectorised := bufio.CreateVectorisedWriter(conn)
+	if isVectorised {
+		c.writer = writer
+	}
+	go c.loopWrite()
+	return c
+}
+
+func (c *jitterConn) Write(p []byte) (n int, err error) {
+	buffer := buf.NewSize(len(p))
+	common.Must1(buffer.Write(p))
+	err = c.enqueue([]*buf.Buffer{buffer})
+	if err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+func (c *jitterConn) WriteVectorised(buffers []*buf.Buffer) error {
+	return c.enqueue(buffers)
+}
+
+func (c *jitterConn) enqueue(buffers []*buf.Buffer) error {
+	c.access.Lock()
+	for c.queuedBytes >= jitterQueueLimit && !c.closed && c.err == nil && !c.writeTimedOut() {
+		c.queueUpdate.Wait()
+	}
+	if c.err != nil || c.closed {
+		err := c.err
+		c.access.Unlock()
+		buf.ReleaseMulti(buffers)
+		if err == nil {
+			err = net.ErrClosed
+		}
+		return err
+	}
+	if c.writeTimedOut() {
+		c.access.Unlock()
+		buf.ReleaseMulti(buffers)
+		return os.ErrDeadlineExceeded
+	}
+	c.queue = append(c.queue, buffers)
+	c.queuedBytes += buf.LenMulti(buffers)
+	c.access.Unlock()
+	notify(c.notify)
+	return nil
+}
+
+// writeTimedOut must be called with access held.
+func (c *jitterConn) writeTimedOut() bool {
+	return !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline)
+}
+
+func (c *jitterConn) SetDeadline(t time.Time) error {
+	err := c.Conn.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *jitterConn) SetWriteDeadline(t time.Time) error {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.writeDeadline = t
+	if c.deadlineTimer != nil {
+		c.deadlineTimer.Stop()
+		c.deadlineTimer = nil
+	}
+	if !t.IsZero() {
+		c.deadlineTimer = time.AfterFunc(time.Until(t), func() {
+			c.access.Lock()
+			c.queueUpdate.Broadcast()
+			c.access.Unlock()
+		})
+	}
+	c.queueUpdate.Broadcast()
+	return nil
+}
+
+// takeQueue must be called with access held.
+func (c *jitterConn) takeQueue(n int) []*buf.Buffer {
+	if n > len(c.queue) {
+		n = len(c.queue)
+	}
+	var buffers []*buf.Buffer
+	for i := 0; i < n; i++ {
+		buffers = append(buffers, c.queue[i]...)
+		c.queue[i] = nil
+	}
+	c.queue = c.queue[n:]
+	c.queuedBytes -= buf.LenMulti(buffers)
+	c.queueUpdate.Broadcast()
+	return buffers
+}
+
+func (c *jitterConn) writeBuffers(buffers []*buf.Buffer) error {
+	if c.writer != nil {
+		return c.writer.WriteVectorised(buffers)
+	}
+	defer buf.ReleaseMulti(buffers)
+	for _, buffer := range buffers {
+		_, err := c.Conn.Write(buffer.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *jitterConn) loopWrite() {
+	burst := c.options.Burst
+	if burst == 0 {
+		burst = 1
+	}
+	for {
+		select {
+		case <-c.notify:
+		case <-c.done:
+			return
+		}
+		for {
+			c.access.Lock()
+			queued := len(c.queue) > 0
+			c.access.Unlock()
+			if !queued {
+				break
+			}
+			timer := time.NewTimer(c.options.delay())
+			select {
+			case <-timer.C:
+			case <-c.done:
+				timer.Stop()
+				return
+			}
+			c.writeAccess.Lock()
+			c.access.Lock()
+			buffers := c.takeQueue(burst)
+			c.access.Unlock()
+			err := c.writeBuffers(buffers)
+			c.writeAccess.Unlock()
+			if err != nil {
+				c.access.Lock()
+				c.err = err
+				buf.ReleaseMulti(c.takeQueue(len(c.queue)))
+				c.access.Unlock()
+				c.Conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// Close flushes queued writes without delay before closing the connection, unless a write is in progress,
+// so that a stalled peer can not block it. The flush is bounded by closeFlushTimeout.
+func (c *jitterConn) Close() error {
+	c.access.Lock()
+	if c.closed {
+		c.access.Unlock()
+		return c.Conn.Close()
+	}
+	c.closed = true
+	close(c.done)
+	if c.deadlineTimer != nil {
+		c.deadlineTimer.Stop()
+		c.deadlineTimer = nil
+	}
+	c.queueUpdate.Broadcast()
+	var buffers []*buf.Buffer
+	if c.err == nil {
+		buffers = c.takeQueue(len(c.queue))
+	}
+	c.access.Unlock()
+	if len(buffers) > 0 {
+		if c.writeAccess.TryLock() {
+			_ = c.Conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+			_ = c.writeBuffers(buffers)
+			c.writeAccess.Unlock()
+		} else {
+			buf.ReleaseMulti(buffers)
+		}
+	}
+	return c.Conn.Close()
+}
+
+func (c *jitterConn) Upstream() any {
+	return c.Conn
+}
@@ -0,0 +1,81 @@
+// Package metrics exports the statistics of a mux Client or Service for monitoring.
+//
+// Publish registers them with expvar. Metrics is also laid out as Prometheus-style counters, gauges
+// and a cumulative histogram, so a Prometheus collector can be built on Collect without this
+// package depending on the Prometheus client.
+package metrics
+
+import (
+	"expvar"
+	"strconv"
+
+	mux "github.com/sagernet/sing-mux"
+)
+
+// Source is implemented by *mux.Client and *mux.Service.
+type Source interface {
+	Stats() mux.Stats
+}
+
+// Metrics are the monitored values of a Client or Service.
+type Metrics struct {
+	// gauges
+	ActiveSessions int `json:"active_sessions"`
+	ActiveStreams  int `json:"active_streams"`
+	// counters
+	StreamsOpened     uint64            `json:"streams_opened_total"`
+	StreamsClosed     uint64            `json:"streams_closed_total"`
+	UploadBytes       uint64            `json:"upload_bytes_total"`
+	DownloadBytes     uint64            `json:"download_bytes_total"`
+	PaddingBytes      uint64            `json:"padding_bytes_total"`
+	HandshakeFailures map[string]uint64 `json:"handshake_failures_total"`
+	// histogram
+	StreamOpenLatency Histogram `json:"stream_open_latency_seconds"`
+}
+
+// Histogram is a cumulative histogram: Buckets maps each upper bound in seconds,
+// and "+Inf", to the number of samples no greater than it.
+type Histogram struct {
+	Buckets map[string]uint64 `json:"buckets"`
+	Count   uint64            `json:"count"`
+	Sum     float64           `json:"sum"`
+}
+
+// Collect computes the metrics of a statistics snapshot.
+func Collect(stats mux.Stats) Metrics {
+	metrics := Metrics{
+		ActiveSessions:    len(stats.Sessions),
+		StreamsOpened:     stats.StreamsOpened,
+		StreamsClosed:     stats.StreamsClosed,
+		UploadBytes:       stats.Upload,
+		DownloadBytes:     stats.Download,
+		PaddingBytes:      stats.PaddingOverhead,
+		HandshakeFailures: stats.HandshakeFailures,
+		StreamOpenLatency: Histogram{
+			Buckets: make(map[string]uint64),
+			Count:   stats.StreamOpenLatency.Count,
+			Sum:     stats.StreamOpenLatency.Sum.Seconds(),
+		},
+	}
+	for _, session := range stats.Sessions {
+		metrics.ActiveStreams += session.ActiveStreams
+	}
+	var cumulative uint64
+	for i, count := range stats.StreamOpenLatency.Counts {
+		cumulative += count
+		if i < len(mux.LatencyBuckets) {
+			metrics.StreamOpenLatency.Buckets[strconv.FormatFloat(mux.LatencyBuckets[i].Seconds(), 'g', -1, 64)] = cumulative
+		} else {
+			metrics.StreamOpenLatency.Buckets["+Inf"] = cumulative
+		}
+	}
+	return metrics
+}
+
+// Publish registers the metrics of source with expvar under name, collecting them on every read.
+// Like expvar.Publish, it panics if name is already registered.
+func Publish(name string, source Source) {
+	expvar.Publish(name, expvar.Func(func() any {
+		return Collect(source.Stats())
+	}))
+}
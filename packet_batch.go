@@ -0,0 +1,186 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// MaxBatchPacketSize is the largest packet carried by batched packet streams.
+const MaxBatchPacketSize = 1024 * 1024
+
+// PacketBatchWriter is implemented by the packet streams of clients and services.
+// Batched streams send all packets in a single stream write, and other streams write them one by one.
+// It takes ownership of the buffers. Destinations are ignored by streams with a fixed destination.
+type PacketBatchWriter interface {
+	WritePacketBatch(buffers []*buf.Buffer, destinations []M.Socksaddr) error
+}
+
+var (
+	_ PacketBatchWriter = (*clientPacketConn)(nil)
+	_ PacketBatchWriter = (*clientPacketAddrConn)(nil)
+	_ PacketBatchWriter = (*serverPacketConn)(nil)
+	_ PacketBatchWriter = (*serverPacketAddrConn)(nil)
+)
+
+// packetFraming reads and writes packet headers.
+// Packets are framed as [address] + length(2) + payload, where the address is only present on PacketAddr streams.
+// On batched streams, every write is a batch of count(2) packets framed as [address] + length(4) + payload.
+type packetFraming struct {
+	addr          bool
+	batch         bool
+	readRemaining int
+}
+
+func (f *packetFraming) headerLen(destination M.Socksaddr) int {
+	var headerLen int
+	if f.addr {
+		headerLen += M.SocksaddrSerializer.AddrPortLen(destination)
+	}
+	if f.batch {
+		headerLen += 4
+	} else {
+		headerLen += 2
+	}
+	return headerLen
+}
+
+// singleHeaderLen is the header length of a write of a single packet.
+func (f *packetFraming) singleHeaderLen(destination M.Socksaddr) int {
+	headerLen := f.headerLen(destination)
+	if f.batch {
+		headerLen += 2
+	}
+	return headerLen
+}
+
+func (f *packetFraming) frontHeadroom() int {
+	var headroom int
+	if f.addr {
+		headroom += M.MaxSocksaddrLength
+	}
+	if f.batch {
+		headroom += 2 + 4
+	} else {
+		headroom += 2
+	}
+	return headroom
+}
+
+func (f *packetFraming) writePacketHeader(buffer *buf.Buffer, destination M.Socksaddr, length int) error {
+	if f.addr {
+		err := M.SocksaddrSerializer.WriteAddrPort(buffer, destination)
+		if err != nil {
+			return err
+		}
+	}
+	if f.batch {
+		if length > MaxBatchPacketSize {
+			return E.New("packet too large: ", length)
+		}
+		common.Must(binary.Write(buffer, binary.BigEndian, uint32(length)))
+	} else {
+		common.Must(binary.Write(buffer, binary.BigEndian, uint16(length)))
+	}
+	return nil
+}
+
+// writeHeader writes the header of a write of a single packet.
+func (f *packetFraming) writeHeader(buffer *buf.Buffer, destination M.Socksaddr, length int) error {
+	if f.batch {
+		common.Must(binary.Write(buffer, binary.BigEndian, uint16(1)))
+	}
+	return f.writePacketHeader(buffer, destination, length)
+}
+
+func (f *packetFraming) readHeader(reader io.Reader) (destination M.Socksaddr, length int, err error) {
+	if f.batch {
+		for f.readRemaining == 0 {
+			var count uint16
+			err = binary.Read(reader, binary.BigEndian, &count)
+			if err != nil {
+				return
+			}
+			f.readRemaining = int(count)
+		}
+		f.readRemaining--
+	}
+	if f.addr {
+		destination, err = M.SocksaddrSerializer.ReadAddrPort(reader)
+		if err != nil {
+			return
+		}
+	}
+	if f.batch {
+		var batchLength uint32
+		err = binary.Read(reader, binary.BigEndian, &batchLength)
+		if err != nil {
+			return
+		}
+		if batchLength > MaxBatchPacketSize {
+			err = E.New("packet too large: ", batchLength)
+			return
+		}
+		length = int(batchLength)
+	} else {
+		var packetLength uint16
+		err = binary.Read(reader, binary.BigEndian, &packetLength)
+		if err != nil {
+			return
+		}
+		length = int(packetLength)
+	}
+	return
+}
+
+// encodeBatch must only be used on batched streams. It takes ownership of the buffers.
+func (f *packetFraming) encodeBatch(buffers []*buf.Buffer, destinations []M.Socksaddr) (*buf.Buffer, error) {
+	defer buf.ReleaseMulti(buffers)
+	if len(buffers) > math.MaxUint16 {
+		return nil, E.New("too many packets in batch: ", len(buffers))
+	}
+	batchLen := 2
+	for i, buffer := range buffers {
+		batchLen += f.headerLen(f.destination(destinations, i)) + buffer.Len()
+	}
+	batch := buf.NewSize(batchLen)
+	common.Must(binary.Write(batch, binary.BigEndian, uint16(len(buffers))))
+	for i, buffer := range buffers {
+		err := f.writePacketHeader(batch, f.destination(destinations, i), buffer.Len())
+		if err != nil {
+			batch.Release()
+			return nil, err
+		}
+		common.Must1(batch.Write(buffer.Bytes()))
+	}
+	return batch, nil
+}
+
+func (f *packetFraming) destination(destinations []M.Socksaddr, index int) M.Socksaddr {
+	if !f.addr {
+		return M.Socksaddr{}
+	}
+	return destinations[index]
+}
+
+// newPacketBuffer makes room for packets larger than the buffers of the read waiter, keeping its headroom.
+func newPacketBuffer(options N.ReadWaitOptions, length int) *buf.Buffer {
+	buffer := options.NewPacketBuffer()
+	if buffer.FreeLen() < length {
+		buffer.Release()
+		buffer = buf.NewSize(options.FrontHeadroom + length + options.RearHeadroom)
+		if options.FrontHeadroom > 0 {
+			buffer.Resize(options.FrontHeadroom, 0)
+		}
+		if options.RearHeadroom > 0 {
+			buffer.Reserve(options.RearHeadroom)
+		}
+	}
+	return buffer
+}
@@ -0,0 +1,161 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func newTestPackets() ([]*buf.Buffer, []M.Socksaddr) {
+	var (
+		buffers      []*buf.Buffer
+		destinations []M.Socksaddr
+	)
+	for i, size := range []int{0, 1, 1500, 65536, MaxBatchPacketSize} {
+		buffer := buf.NewSize(size)
+		for j := 0; j < size; j++ {
+			buffer.WriteByte(byte(i + j))
+		}
+		buffers = append(buffers, buffer)
+	}
+	destinations = []M.Socksaddr{
+		M.ParseSocksaddr("1.1.1.1:53"),
+		M.ParseSocksaddr("[2001:db8::1]:443"),
+		M.ParseSocksaddr("example.com:80"),
+		M.ParseSocksaddr("8.8.8.8:53"),
+		M.ParseSocksaddr("example.org:65535"),
+	}
+	return buffers, destinations
+}
+
+func TestPacketBatchRoundTrip(t *testing.T) {
+	for _, addr := range []bool{false, true} {
+		buffers, destinations := newTestPackets()
+		expected := make([][]byte, len(buffers))
+		for i, buffer := range buffers {
+			expected[i] = append([]byte(nil), buffer.Bytes()...)
+		}
+		framing := packetFraming{addr: addr, batch: true}
+		batch, err := framing.encodeBatch(buffers, destinations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bytes.NewReader(batch.Bytes())
+		readFraming := packetFraming{addr: addr, batch: true}
+		for i := range expected {
+			destination, length, err := readFraming.readHeader(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr && destination.String() != destinations[i].String() {
+				t.Fatal("destination mismatch: ", destination, ", expected ", destinations[i])
+			}
+			if length != len(expected[i]) {
+				t.Fatal("length mismatch: ", length, ", expected ", len(expected[i]))
+			}
+			payload := make([]byte, length)
+			_, err = io.ReadFull(reader, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(payload, expected[i]) {
+				t.Fatal("payload mismatch")
+			}
+		}
+		if readFraming.readRemaining != 0 || reader.Len() != 0 {
+			t.Fatal("unexpected trailing packets")
+		}
+		batch.Release()
+	}
+}
+
+func TestPacketSingleRoundTrip(t *testing.T) {
+	destination := M.ParseSocksaddr("example.com:443")
+	for _, framing := range []packetFraming{{}, {addr: true}, {batch: true}, {addr: true, batch: true}} {
+		buffer := buf.NewSize(framing.singleHeaderLen(destination) + 3)
+		err := framing.writeHeader(buffer, destination, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buffer.Len() != framing.singleHeaderLen(destination) || buffer.Len() > framing.frontHeadroom() {
+			t.Fatal("unexpected header length: ", buffer.Len())
+		}
+		buffer.WriteString("abc")
+		readDestination, length, err := framing.readHeader(bytes.NewReader(buffer.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if length != 3 || framing.addr && readDestination.String() != destination.String() {
+			t.Fatal("header mismatch: ", readDestination, " ", length)
+		}
+		buffer.Release()
+	}
+}
+
+func TestPacketBatchTooLarge(t *testing.T) {
+	framing := packetFraming{batch: true}
+	buffer := buf.NewSize(MaxBatchPacketSize + 1)
+	buffer.Extend(MaxBatchPacketSize + 1)
+	_, err := framing.encodeBatch([]*buf.Buffer{buffer}, nil)
+	if err == nil {
+		t.Fatal("encoded packet larger than MaxBatchPacketSize")
+	}
+	header := []byte{0, 1, 0, 0x10, 0, 1}
+	_, _, err = framing.readHeader(bytes.NewReader(header))
+	if err == nil {
+		t.Fatal("read packet larger than MaxBatchPacketSize")
+	}
+	_, err = framing.encodeBatch(make([]*buf.Buffer, 65536), nil)
+	if err == nil {
+		t.Fatal("encoded batch of more than 65535 packets")
+	}
+}
+
+func TestPacketBatchTruncated(t *testing.T) {
+	buffers, destinations := newTestPackets()
+	framing := packetFraming{addr: true, batch: true}
+	batch, err := framing.encodeBatch(buffers[:3], destinations[:3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer batch.Release()
+	data := batch.Bytes()
+	for truncated := 0; truncated < len(data); truncated++ {
+		reader := bytes.NewReader(data[:truncated])
+		readFraming := packetFraming{addr: true, batch: true}
+		var packets int
+		for {
+			_, length, err := readFraming.readHeader(reader)
+			if err == nil {
+				_, err = io.ReadFull(reader, make([]byte, length))
+			}
+			if err != nil {
+				break
+			}
+			packets++
+		}
+		if packets == 3 {
+			t.Fatal("read all packets from batch truncated to ", truncated, " bytes")
+		}
+	}
+}
+
+func TestNewPacketBufferHeadroom(t *testing.T) {
+	options := N.ReadWaitOptions{FrontHeadroom: 16, RearHeadroom: 8}
+	for _, length := range []int{100, MaxBatchPacketSize} {
+		buffer := newPacketBuffer(options, length)
+		if buffer.Start() != options.FrontHeadroom || buffer.FreeLen() < length {
+			t.Fatal("unexpected buffer for ", length, " bytes: start ", buffer.Start(), ", free ", buffer.FreeLen())
+		}
+		buffer.Extend(length)
+		options.PostReturn(buffer)
+		if buffer.FreeLen() < options.RearHeadroom {
+			t.Fatal("missing rear headroom for ", length, " bytes")
+		}
+		buffer.Release()
+	}
+}
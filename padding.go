@@ -3,34 +3,152 @@ package mux
 import (
 	"encoding/binary"
 	"io"
+	"math"
 	"math/rand"
 	"net"
 
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
 	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
 	N "github.com/sagernet/sing/common/network"
 	"github.com/sagernet/sing/common/rw"
 )
 
-const kFirstPaddings = 16
+// PaddingScheme describes how the first writes of a padded session are padded in both directions.
+// The client announces its scheme in the request, and the server pads with the same scheme.
+type PaddingScheme struct {
+	// Packets is the number of padded writes in each direction.
+	Packets int
+	// Lengths are the padding length ranges of the padded writes in order,
+	// the last one applying to all remaining padded writes.
+	Lengths []PaddingRange
+}
+
+// PaddingRange is an inclusive range of padding lengths.
+type PaddingRange struct {
+	Min int
+	Max int
+}
+
+// DefaultPaddingScheme is used when the request does not announce a scheme.
+var DefaultPaddingScheme = PaddingScheme{
+	Packets: 16,
+	Lengths: []PaddingRange{{Min: 256, Max: 767}},
+}
+
+// Default bounds of the padding schemes accepted by services, which allow DefaultPaddingScheme.
+const (
+	DefaultMaxPaddingPackets = 64
+	DefaultMaxPaddingLength  = 1024
+)
+
+func (s *PaddingScheme) Validate() error {
+	if s.Packets < 0 || s.Packets > math.MaxUint16 {
+		return E.New("invalid padding packets: ", s.Packets)
+	}
+	if len(s.Lengths) == 0 || len(s.Lengths) > math.MaxUint8 {
+		return E.New("invalid padding lengths count: ", len(s.Lengths))
+	}
+	for _, paddingRange := range s.Lengths {
+		if paddingRange.Min < 0 || paddingRange.Min > paddingRange.Max || paddingRange.Max > math.MaxUint16 {
+			return E.New("invalid padding range: ", paddingRange.Min, "-", paddingRange.Max)
+		}
+	}
+	return nil
+}
+
+func (s *PaddingScheme) paddingLen(index int) int {
+	if index >= len(s.Lengths) {
+		index = len(s.Lengths) - 1
+	}
+	paddingRange := s.Lengths[index]
+	return paddingRange.Min + rand.Intn(paddingRange.Max-paddingRange.Min+1)
+}
+
+// encoded as packets(2) + count(1) + count * (min(2) + max(2))
+func (s *PaddingScheme) encodedLen() int {
+	return 3 + 4*len(s.Lengths)
+}
+
+func (s *PaddingScheme) writeTo(buffer *buf.Buffer) {
+	common.Must(
+		binary.Write(buffer, binary.BigEndian, uint16(s.Packets)),
+		buffer.WriteByte(uint8(len(s.Lengths))),
+	)
+	for _, paddingRange := range s.Lengths {
+		common.Must(
+			binary.Write(buffer, binary.BigEndian, uint16(paddingRange.Min)),
+			binary.Write(buffer, binary.BigEndian, uint16(paddingRange.Max)),
+		)
+	}
+}
+
+func readPaddingScheme(reader io.Reader) (*PaddingScheme, error) {
+	var header struct {
+		Packets uint16
+		Count   uint8
+	}
+	err := binary.Read(reader, binary.BigEndian, &header)
+	if err != nil {
+		return nil, err
+	}
+	ranges := make([]struct{ Min, Max uint16 }, header.Count)
+	err = binary.Read(reader, binary.BigEndian, ranges)
+	if err != nil {
+		return nil, err
+	}
+	scheme := &PaddingScheme{
+		Packets: int(header.Packets),
+		Lengths: make([]PaddingRange, 0, len(ranges)),
+	}
+	for _, paddingRange := range ranges {
+		scheme.Lengths = append(scheme.Lengths, PaddingRange{Min: int(paddingRange.Min), Max: int(paddingRange.Max)})
+	}
+	err = scheme.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return scheme, nil
+}
+
+// Padding frames are sent as dataLen + paddingLen(2) + data + padding.
+// Version0 and Version1 sessions encode dataLen in 2 bytes, so larger writes are split
+// into frames of at most 65535 bytes, each taking one of the padded writes.
+// Version2 sessions encode dataLen in 4 bytes, so every write is sent as exactly one frame.
+const (
+	paddingHeaderLen         = 4
+	extendedPaddingHeaderLen = 6
+	paddingMaxDataLen        = math.MaxUint16
+)
 
 type paddingConn struct {
 	N.ExtendedConn
 	writer           N.VectorisedWriter
+	scheme           *PaddingScheme
+	extended         bool
 	readPadding      int
 	writePadding     int
 	readRemaining    int
 	paddingRemaining int
+	onOverhead       func(n int)
 }
 
-func newPaddingConn(conn net.Conn) net.Conn {
+// newPaddingConn pads with scheme, or DefaultPaddingScheme if it is nil, using extended frames for Version2 sessions,
+// and reports the bytes of padding headers and padding written and read to onOverhead.
+func newPaddingConn(conn net.Conn, version byte, scheme *PaddingScheme, onOverhead func(n int)) net.Conn {
+	if scheme == nil {
+		scheme = &DefaultPaddingScheme
+	}
 	writer, isVectorised := bufio.CreateVectorisedWriter(conn)
 	if isVectorised {
 		return &vectorisedPaddingConn{
 			paddingConn{
 				ExtendedConn: bufio.NewExtendedConn(conn),
 				writer:       bufio.NewVectorisedWriter(conn),
+				scheme:       scheme,
+				extended:     version >= Version2,
+				onOverhead:   onOverhead,
 			},
 			writer,
 		}
@@ -38,167 +156,169 @@ func newPaddingConn(conn net.Conn) net.Conn {
 		return &paddingConn{
 			ExtendedConn: bufio.NewExtendedConn(conn),
 			writer:       bufio.NewVectorisedWriter(conn),
+			scheme:       scheme,
+			extended:     version >= Version2,
+			onOverhead:   onOverhead,
 		}
 	}
 }
 
-func (c *paddingConn) Read(p []byte) (n int, err error) {
-	if c.readRemaining > 0 {
-		if len(p) > c.readRemaining {
-			p = p[:c.readRemaining]
-		}
-		n, err = c.ExtendedConn.Read(p)
-		if err != nil {
-			return
-		}
-		c.readRemaining -= n
-		return
-	}
-	if c.paddingRemaining > 0 {
-		err = rw.SkipN(c.ExtendedConn, c.paddingRemaining)
-		if err != nil {
-			return
-		}
-		c.paddingRemaining = 0
-	}
-	if c.readPadding < kFirstPaddings {
-		var paddingHdr []byte
-		if len(p) >= 4 {
-			paddingHdr = p[:4]
-		} else {
-			paddingHdr = make([]byte, 4)
-		}
-		_, err = io.ReadFull(c.ExtendedConn, paddingHdr)
-		if err != nil {
-			return
-		}
-		originalDataSize := int(binary.BigEndian.Uint16(paddingHdr[:2]))
-		paddingLen := int(binary.BigEndian.Uint16(paddingHdr[2:]))
-		if len(p) > originalDataSize {
-			p = p[:originalDataSize]
-		}
-		n, err = c.ExtendedConn.Read(p)
-		if err != nil {
-			return
-		}
-		c.readPadding++
-		c.readRemaining = originalDataSize - n
-		c.paddingRemaining = paddingLen
-		return
+func (c *paddingConn) headerLen() int {
+	if c.extended {
+		return extendedPaddingHeaderLen
 	}
-	return c.ExtendedConn.Read(p)
+	return paddingHeaderLen
 }
 
-func (c *paddingConn) Write(p []byte) (n int, err error) {
-	for pLen := len(p); pLen > 0; {
-		var data []byte
-		if pLen > 65535 {
-			data = p[:65535]
-			p = p[65535:]
-			pLen -= 65535
-		} else {
-			data = p
-			pLen = 0
-		}
-		var writeN int
-		writeN, err = c.write(data)
-		n += writeN
-		if err != nil {
-			break
-		}
+// fitsFrame reports whether dataLen bytes can be sent in a single frame.
+func (c *paddingConn) fitsFrame(dataLen int) bool {
+	return c.extended && uint64(dataLen) <= math.MaxUint32 || dataLen <= paddingMaxDataLen
+}
+
+func (c *paddingConn) putHeader(header []byte, dataLen int, paddingLen int) {
+	if c.extended {
+		binary.BigEndian.PutUint32(header[:4], uint32(dataLen))
+	} else {
+		binary.BigEndian.PutUint16(header[:2], uint16(dataLen))
 	}
-	return n, err
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(paddingLen))
 }
 
-func (c *paddingConn) write(p []byte) (n int, err error) {
-	if c.writePadding < kFirstPaddings {
-		paddingLen := 256 + rand.Intn(512)
-		buffer := buf.NewSize(4 + len(p) + paddingLen)
-		defer buffer.Release()
-		header := buffer.Extend(4)
-		binary.BigEndian.PutUint16(header[:2], uint16(len(p)))
-		binary.BigEndian.PutUint16(header[2:], uint16(paddingLen))
-		common.Must1(buffer.Write(p))
-		buffer.Extend(paddingLen)
-		_, err = c.ExtendedConn.Write(buffer.Bytes())
-		if err == nil {
-			n = len(p)
-		}
-		c.writePadding++
-		return
+// readFrame must be called with no data or padding of the last frame remaining.
+// It reads the next frame header, using p as scratch space, and returns the data length of the frame.
+func (c *paddingConn) readFrame(p []byte) (int, error) {
+	headerLen := c.headerLen()
+	var header []byte
+	if len(p) >= headerLen {
+		header = p[:headerLen]
+	} else {
+		header = make([]byte, headerLen)
+	}
+	_, err := io.ReadFull(c.ExtendedConn, header)
+	if err != nil {
+		return 0, err
 	}
-	return c.ExtendedConn.Write(p)
+	var dataLen int
+	if c.extended {
+		dataLen = int(binary.BigEndian.Uint32(header[:4]))
+	} else {
+		dataLen = int(binary.BigEndian.Uint16(header[:2]))
+	}
+	paddingLen := int(binary.BigEndian.Uint16(header[headerLen-2:]))
+	c.readPadding++
+	c.readRemaining = dataLen
+	c.paddingRemaining = paddingLen
+	c.onOverhead(headerLen + paddingLen)
+	return dataLen, nil
 }
 
-func (c *paddingConn) ReadBuffer(buffer *buf.Buffer) error {
-	p := buffer.FreeBytes()
-	if c.readRemaining > 0 {
-		if len(p) > c.readRemaining {
-			p = p[:c.readRemaining]
+func (c *paddingConn) Read(p []byte) (n int, err error) {
+	for c.readRemaining == 0 {
+		if c.paddingRemaining > 0 {
+			err = rw.SkipN(c.ExtendedConn, c.paddingRemaining)
+			if err != nil {
+				return
+			}
+			c.paddingRemaining = 0
 		}
-		n, err := c.ExtendedConn.Read(p)
+		if c.readPadding >= c.scheme.Packets {
+			return c.ExtendedConn.Read(p)
+		}
+		_, err = c.readFrame(p)
 		if err != nil {
-			return err
+			return
 		}
-		c.readRemaining -= n
-		buffer.Truncate(n)
-		return nil
 	}
-	if c.paddingRemaining > 0 {
-		err := rw.SkipN(c.ExtendedConn, c.paddingRemaining)
-		if err != nil {
-			return err
+	if len(p) > c.readRemaining {
+		p = p[:c.readRemaining]
+	}
+	n, err = c.ExtendedConn.Read(p)
+	c.readRemaining -= n
+	return
+}
+
+func (c *paddingConn) ReadBuffer(buffer *buf.Buffer) error {
+	p := buffer.FreeBytes()
+	for c.readRemaining == 0 {
+		if c.paddingRemaining > 0 {
+			err := rw.SkipN(c.ExtendedConn, c.paddingRemaining)
+			if err != nil {
+				return err
+			}
+			c.paddingRemaining = 0
 		}
-		c.paddingRemaining = 0
-	}
-	if c.readPadding < kFirstPaddings {
-		var paddingHdr []byte
-		if len(p) >= 4 {
-			paddingHdr = p[:4]
-		} else {
-			paddingHdr = make([]byte, 4)
+		if c.readPadding >= c.scheme.Packets {
+			return c.ExtendedConn.ReadBuffer(buffer)
 		}
-		_, err := io.ReadFull(c.ExtendedConn, paddingHdr)
+		_, err := c.readFrame(p)
 		if err != nil {
 			return err
 		}
-		originalDataSize := int(binary.BigEndian.Uint16(paddingHdr[:2]))
-		paddingLen := int(binary.BigEndian.Uint16(paddingHdr[2:]))
+	}
+	if len(p) > c.readRemaining {
+		p = p[:c.readRemaining]
+	}
+	n, err := c.ExtendedConn.Read(p)
+	c.readRemaining -= n
+	buffer.Truncate(n)
+	return err
+}
 
-		if len(p) > originalDataSize {
-			p = p[:originalDataSize]
+func (c *paddingConn) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if c.writePadding >= c.scheme.Packets {
+			var writeN int
+			writeN, err = c.ExtendedConn.Write(p)
+			n += writeN
+			return
+		}
+		data := p
+		if !c.fitsFrame(len(data)) {
+			data = data[:paddingMaxDataLen]
 		}
-		n, err := c.ExtendedConn.Read(p)
+		err = c.writeFrame(data)
 		if err != nil {
-			return err
+			return
 		}
-		c.readPadding++
-		c.readRemaining = originalDataSize - n
-		c.paddingRemaining = paddingLen
-		buffer.Truncate(n)
-		return nil
+		n += len(data)
+		p = p[len(data):]
 	}
-	return c.ExtendedConn.ReadBuffer(buffer)
+	return
+}
+
+// writeFrame sends data, which must fit a single frame, as the next padded write.
+func (c *paddingConn) writeFrame(data []byte) error {
+	headerLen := c.headerLen()
+	paddingLen := c.scheme.paddingLen(c.writePadding)
+	buffer := buf.NewSize(headerLen + len(data) + paddingLen)
+	defer buffer.Release()
+	c.putHeader(buffer.Extend(headerLen), len(data), paddingLen)
+	common.Must1(buffer.Write(data))
+	buffer.Extend(paddingLen)
+	c.writePadding++
+	c.onOverhead(headerLen + paddingLen)
+	return common.Error(c.ExtendedConn.Write(buffer.Bytes()))
 }
 
 func (c *paddingConn) WriteBuffer(buffer *buf.Buffer) error {
-	if c.writePadding < kFirstPaddings {
+	if c.writePadding < c.scheme.Packets {
+		headerLen := c.headerLen()
 		bufferLen := buffer.Len()
-		if bufferLen > 65535 {
+		paddingLen := c.scheme.paddingLen(c.writePadding)
+		if !c.fitsFrame(bufferLen) || buffer.Start() < headerLen || buffer.FreeLen() < paddingLen {
+			defer buffer.Release()
 			return common.Error(c.Write(buffer.Bytes()))
 		}
-		paddingLen := 256 + rand.Intn(512)
-		header := buffer.ExtendHeader(4)
-		binary.BigEndian.PutUint16(header[:2], uint16(bufferLen))
-		binary.BigEndian.PutUint16(header[2:], uint16(paddingLen))
+		c.putHeader(buffer.ExtendHeader(headerLen), bufferLen, paddingLen)
 		buffer.Extend(paddingLen)
 		c.writePadding++
+		c.onOverhead(headerLen + paddingLen)
 	}
 	return c.ExtendedConn.WriteBuffer(buffer)
 }
 
 func (c *paddingConn) FrontHeadroom() int {
-	return 4 + 256 + 1024
+	return extendedPaddingHeaderLen + 256 + 1024
 }
 
 func (c *paddingConn) Upstream() any {
@@ -211,25 +331,23 @@ type vectorisedPaddingConn struct {
 }
 
 func (c *vectorisedPaddingConn) WriteVectorised(buffers []*buf.Buffer) error {
-	if c.writePadding < kFirstPaddings {
+	if c.writePadding < c.scheme.Packets {
 		bufferLen := buf.LenMulti(buffers)
-		if bufferLen > 65535 {
+		if !c.fitsFrame(bufferLen) {
+			// split the joined data exactly like Write does
 			defer buf.ReleaseMulti(buffers)
+			data := make([]byte, 0, bufferLen)
 			for _, buffer := range buffers {
-				_, err := c.Write(buffer.Bytes())
-				if err != nil {
-					return err
-				}
+				data = append(data, buffer.Bytes()...)
 			}
-			return nil
+			return common.Error(c.Write(data))
 		}
-		paddingLen := 256 + rand.Intn(512)
-		header := buf.NewSize(4)
-		common.Must(
-			binary.Write(header, binary.BigEndian, uint16(bufferLen)),
-			binary.Write(header, binary.BigEndian, uint16(paddingLen)),
-		)
+		headerLen := c.headerLen()
+		paddingLen := c.scheme.paddingLen(c.writePadding)
+		header := buf.NewSize(headerLen)
+		c.putHeader(header.Extend(headerLen), bufferLen, paddingLen)
 		c.writePadding++
+		c.onOverhead(headerLen + paddingLen)
 		padding := buf.NewSize(paddingLen)
 		padding.Extend(paddingLen)
 		buffers = append(append([]*buf.Buffer{header}, buffers...), padding)
@@ -0,0 +1,176 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const (
+	paddingWriteModeWrite = iota
+	paddingWriteModeWriteBuffer
+	paddingWriteModeWriteVectorised
+)
+
+// paddingTestConn stores written data to be read back, and is vectorised so that padding conns take the vectorised path.
+type paddingTestConn struct {
+	net.Conn
+	buffer bytes.Buffer
+}
+
+func (c *paddingTestConn) Read(p []byte) (n int, err error) {
+	return c.buffer.Read(p)
+}
+
+func (c *paddingTestConn) Write(p []byte) (n int, err error) {
+	return c.buffer.Write(p)
+}
+
+func (c *paddingTestConn) WriteVectorised(buffers []*buf.Buffer) error {
+	defer buf.ReleaseMulti(buffers)
+	for _, buffer := range buffers {
+		c.buffer.Write(buffer.Bytes())
+	}
+	return nil
+}
+
+func FuzzPaddingRoundTrip(f *testing.F) {
+	f.Add(uint8(Version2), []byte("padding"), uint8(16), uint32(1000), uint32(100), uint8(paddingWriteModeWrite), uint16(512), false)
+	f.Add(uint8(Version2), []byte("padding"), uint8(4), uint32(200000), uint32(70000), uint8(paddingWriteModeWriteBuffer), uint16(4096), true)
+	f.Add(uint8(Version2), []byte{0, 1, 2}, uint8(2), uint32(140000), uint32(140000), uint8(paddingWriteModeWriteVectorised), uint16(65535), false)
+	f.Add(uint8(Version2), []byte{}, uint8(0), uint32(65536), uint32(65535), uint8(paddingWriteModeWriteVectorised), uint16(1), true)
+	// Version0 and Version1 split writes into frames of at most 65535 bytes
+	f.Add(uint8(Version0), []byte("padding"), uint8(16), uint32(1000), uint32(100), uint8(paddingWriteModeWrite), uint16(512), false)
+	f.Add(uint8(Version1), []byte("padding"), uint8(4), uint32(200000), uint32(70000), uint8(paddingWriteModeWriteBuffer), uint16(4096), true)
+	f.Add(uint8(Version1), []byte{0, 1, 2}, uint8(20), uint32(140000), uint32(140000), uint8(paddingWriteModeWriteVectorised), uint16(65535), false)
+	f.Add(uint8(Version0), []byte{}, uint8(0), uint32(65536), uint32(65535), uint8(paddingWriteModeWriteVectorised), uint16(1), true)
+	f.Fuzz(func(t *testing.T, version uint8, seed []byte, packets uint8, size uint32, chunkSize uint32, writeMode uint8, readSize uint16, readBuffer bool) {
+		version %= Version2 + 1
+		payload := make([]byte, size%300000)
+		for i := range payload {
+			if len(seed) > 0 {
+				payload[i] = seed[i%len(seed)] + byte(i/len(seed))
+			} else {
+				payload[i] = byte(i)
+			}
+		}
+		scheme := &PaddingScheme{
+			Packets: int(packets % 32),
+			Lengths: []PaddingRange{{Min: 0, Max: 300}, {Min: 100, Max: 100}},
+		}
+		conn := &paddingTestConn{}
+		writer := newPaddingConn(conn, version, scheme, func(int) {})
+		chunkLen := int(chunkSize%200000) + 1
+		for remaining := payload; len(remaining) > 0; {
+			chunk := remaining
+			if len(chunk) > chunkLen {
+				chunk = chunk[:chunkLen]
+			}
+			remaining = remaining[len(chunk):]
+			var err error
+			switch writeMode % 3 {
+			case paddingWriteModeWrite:
+				_, err = writer.Write(chunk)
+			case paddingWriteModeWriteBuffer:
+				headroom := N.CalculateFrontHeadroom(writer)
+				buffer := buf.NewSize(headroom + len(chunk) + 1024)
+				buffer.Resize(headroom, 0)
+				common.Must1(buffer.Write(chunk))
+				err = writer.(N.ExtendedWriter).WriteBuffer(buffer)
+			case paddingWriteModeWriteVectorised:
+				vectorisedWriter, isVectorised := writer.(N.VectorisedWriter)
+				if !isVectorised {
+					t.Fatal("padding conn is not vectorised")
+				}
+				middle := len(chunk) / 2
+				err = vectorisedWriter.WriteVectorised([]*buf.Buffer{buf.As(chunk[:middle]).ToOwned(), buf.As(chunk[middle:]).ToOwned()})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		reader := newPaddingConn(conn, version, scheme, func(int) {})
+		bufferSize := int(readSize) + 1
+		received := make([]byte, 0, len(payload))
+		for {
+			var err error
+			if readBuffer {
+				buffer := buf.NewSize(bufferSize)
+				err = reader.(N.ExtendedReader).ReadBuffer(buffer)
+				received = append(received, buffer.Bytes()...)
+				buffer.Release()
+			} else {
+				p := make([]byte, bufferSize)
+				var n int
+				n, err = reader.Read(p)
+				received = append(received, p[:n]...)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(received, payload) {
+			t.Fatal("payload mismatch: ", len(received), " != ", len(payload))
+		}
+	})
+}
+
+func TestPaddingSchemeRoundTrip(t *testing.T) {
+	for _, scheme := range []PaddingScheme{
+		DefaultPaddingScheme,
+		{Packets: 0, Lengths: []PaddingRange{{Min: 0, Max: 0}}},
+		{Packets: 3, Lengths: []PaddingRange{{Min: 100, Max: 100}, {Min: 0, Max: 10}, {Min: 1, Max: 65535}}},
+	} {
+		buffer := buf.NewSize(scheme.encodedLen())
+		scheme.writeTo(buffer)
+		if buffer.Len() != scheme.encodedLen() {
+			t.Fatal("unexpected encoded length: ", buffer.Len())
+		}
+		decoded, err := readPaddingScheme(bytes.NewReader(buffer.Bytes()))
+		buffer.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*decoded, scheme) {
+			t.Fatal("padding scheme mismatch: ", decoded)
+		}
+	}
+}
+
+func TestPaddingSchemeMalformed(t *testing.T) {
+	for _, encoded := range [][]byte{
+		{},
+		{0, 16},
+		{0, 16, 1, 1, 0},
+		{0, 16, 2, 1, 0, 2, 0},
+		// no ranges
+		{0, 16, 0},
+		// min above max
+		{0, 16, 1, 2, 0, 1, 0},
+	} {
+		_, err := readPaddingScheme(bytes.NewReader(encoded))
+		if err == nil {
+			t.Fatal("read malformed padding scheme: ", encoded)
+		}
+	}
+	for _, scheme := range []PaddingScheme{
+		{Packets: -1, Lengths: []PaddingRange{{Min: 0, Max: 0}}},
+		{Packets: 65536, Lengths: []PaddingRange{{Min: 0, Max: 0}}},
+		{Packets: 1, Lengths: make([]PaddingRange, 256)},
+		{Packets: 1, Lengths: []PaddingRange{{Min: -1, Max: 0}}},
+		{Packets: 1, Lengths: []PaddingRange{{Min: 0, Max: 65536}}},
+	} {
+		if scheme.Validate() == nil {
+			t.Fatal("invalid padding scheme validated: ", scheme.Packets, " ", len(scheme.Lengths))
+		}
+	}
+}
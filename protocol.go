@@ -3,7 +3,6 @@ package mux
 import (
 	"encoding/binary"
 	"io"
-	"math/rand"
 	"time"
 
 	"github.com/sagernet/sing/common"
@@ -19,11 +18,38 @@ const (
 	ProtocolSmux = iota
 	ProtocolYAMux
 	ProtocolH2Mux
+	ProtocolSingMux
 )
 
+func protocolName(protocol byte) string {
+	switch protocol {
+	case ProtocolSmux:
+		return "smux"
+	case ProtocolYAMux:
+		return "yamux"
+	case ProtocolH2Mux:
+		return "h2mux"
+	case ProtocolSingMux:
+		return "singmux"
+	default:
+		return "unknown"
+	}
+}
+
 const (
 	Version0 = iota
 	Version1
+	// Version2 replaces the padding flag of Version1 with request flags,
+	// followed by the options they announce. Padded Version2 sessions use extended padding frames.
+	Version2
+)
+
+const (
+	requestFlagPadding = 1 << iota
+	requestFlagAuth
+	requestFlagPaddingScheme
+	requestFlagShaping
+	requestFlagJitter
 )
 
 const (
@@ -39,6 +65,59 @@ type Request struct {
 	Version  byte
 	Protocol byte
 	Padding  bool
+	// Auth, PaddingScheme, Shaping and Jitter are only encoded in Version2 requests.
+	// PaddingScheme and Shaping require Padding.
+	Auth          *RequestAuth
+	PaddingScheme *PaddingScheme
+	Shaping       *ShapingOptions
+	Jitter        *JitterOptions
+}
+
+func (r *Request) flags() byte {
+	var flags byte
+	if r.Padding {
+		flags |= requestFlagPadding
+	}
+	if r.Auth != nil {
+		flags |= requestFlagAuth
+	}
+	if r.Padding && r.PaddingScheme != nil {
+		flags |= requestFlagPaddingScheme
+	}
+	if r.Padding && r.Shaping != nil {
+		flags |= requestFlagShaping
+	}
+	if r.Jitter != nil {
+		flags |= requestFlagJitter
+	}
+	return flags
+}
+
+// optionsLen is the length of the options following the Auth of Version2 requests.
+func (r *Request) optionsLen() int {
+	var optionsLen int
+	if r.Padding && r.PaddingScheme != nil {
+		optionsLen += r.PaddingScheme.encodedLen()
+	}
+	if r.Padding && r.Shaping != nil {
+		optionsLen += shapingOptionsLen
+	}
+	if r.Jitter != nil {
+		optionsLen += jitterOptionsLen
+	}
+	return optionsLen
+}
+
+func (r *Request) writeOptions(buffer *buf.Buffer) {
+	if r.Padding && r.PaddingScheme != nil {
+		r.PaddingScheme.writeTo(buffer)
+	}
+	if r.Padding && r.Shaping != nil {
+		r.Shaping.writeTo(buffer)
+	}
+	if r.Jitter != nil {
+		r.Jitter.writeTo(buffer)
+	}
 }
 
 func ReadRequest(reader io.Reader) (*Request, error) {
@@ -50,44 +129,87 @@ func ReadRequest(reader io.Reader) (*Request, error) {
 	if err != nil {
 		return nil, err
 	}
-	if version < Version0 || version > Version1 {
+	if version < Version0 || version > Version2 {
 		return nil, E.New("unsupported version: ", version)
 	}
 	err = binary.Read(reader, binary.BigEndian, &protocol)
 	if err != nil {
 		return nil, err
 	}
-	var paddingEnabled bool
-	if version == Version1 {
-		err = binary.Read(reader, binary.BigEndian, &paddingEnabled)
+	request := &Request{Version: version, Protocol: protocol}
+	switch version {
+	case Version1:
+		err = binary.Read(reader, binary.BigEndian, &request.Padding)
+		if err != nil {
+			return nil, err
+		}
+	case Version2:
+		var flags byte
+		err = binary.Read(reader, binary.BigEndian, &flags)
 		if err != nil {
 			return nil, err
 		}
-		if paddingEnabled {
-			var paddingLen uint16
-			err = binary.Read(reader, binary.BigEndian, &paddingLen)
+		request.Padding = flags&requestFlagPadding != 0
+		if flags&requestFlagAuth != 0 {
+			request.Auth = new(RequestAuth)
+			err = binary.Read(reader, binary.BigEndian, request.Auth)
 			if err != nil {
 				return nil, err
 			}
-			err = rw.SkipN(reader, int(paddingLen))
+		}
+		if flags&requestFlagPaddingScheme != 0 {
+			request.PaddingScheme, err = readPaddingScheme(reader)
 			if err != nil {
-				return nil, err
+				return nil, E.Cause(err, "read padding scheme")
 			}
 		}
+		if flags&requestFlagShaping != 0 {
+			request.Shaping, err = readShapingOptions(reader)
+			if err != nil {
+				return nil, E.Cause(err, "read shaping options")
+			}
+		}
+		if flags&requestFlagJitter != 0 {
+			request.Jitter, err = readJitterOptions(reader)
+			if err != nil {
+				return nil, E.Cause(err, "read jitter options")
+			}
+		}
+	}
+	if request.Padding {
+		var paddingLen uint16
+		err = binary.Read(reader, binary.BigEndian, &paddingLen)
+		if err != nil {
+			return nil, err
+		}
+		err = rw.SkipN(reader, int(paddingLen))
+		if err != nil {
+			return nil, err
+		}
 	}
-	return &Request{Version: version, Protocol: protocol, Padding: paddingEnabled}, nil
+	return request, nil
 }
 
 func EncodeRequest(request Request, payload []byte) *buf.Buffer {
 	var requestLen int
 	requestLen += 2
-	var paddingLen uint16
-	if request.Version == Version1 {
+	var paddingLen int
+	if request.Version >= Version1 {
 		requestLen += 1
+		if request.Version == Version2 {
+			if request.Auth != nil {
+				requestLen += authLen
+			}
+			requestLen += request.optionsLen()
+		}
 		if request.Padding {
+			paddingScheme := request.PaddingScheme
+			if paddingScheme == nil {
+				paddingScheme = &DefaultPaddingScheme
+			}
 			requestLen += 2
-			paddingLen = uint16(256 + rand.Intn(512))
-			requestLen += int(paddingLen)
+			paddingLen = paddingScheme.paddingLen(0)
+			requestLen += paddingLen
 		}
 	}
 	buffer := buf.NewSize(requestLen + len(payload))
@@ -95,28 +217,45 @@ func EncodeRequest(request Request, payload []byte) *buf.Buffer {
 		buffer.WriteByte(request.Version),
 		buffer.WriteByte(request.Protocol),
 	)
-	if request.Version == Version1 {
+	switch request.Version {
+	case Version1:
 		common.Must(binary.Write(buffer, binary.BigEndian, request.Padding))
-		if request.Padding {
-			common.Must(binary.Write(buffer, binary.BigEndian, paddingLen))
-			buffer.Extend(int(paddingLen))
+	case Version2:
+		common.Must(buffer.WriteByte(request.flags()))
+		if request.Auth != nil {
+			common.Must(binary.Write(buffer, binary.BigEndian, request.Auth))
 		}
+		request.writeOptions(buffer)
+	}
+	if request.Version >= Version1 && request.Padding {
+		common.Must(binary.Write(buffer, binary.BigEndian, uint16(paddingLen)))
+		buffer.Extend(paddingLen)
 	}
 	common.Must1(buffer.Write(payload))
 	return buffer
 }
 
 const (
-	flagUDP       = 1
-	flagAddr      = 2
-	statusSuccess = 0
-	statusError   = 1
+	flagUDP         = 1
+	flagAddr        = 2
+	flagErrorCode   = 4
+	flagPacketBatch = 8
+	statusSuccess   = 0
+	statusError     = 1
+	// statusErrorCode is followed by an ErrorCode before the message,
+	// and only sent in response to requests with flagErrorCode.
+	statusErrorCode = 2
 )
 
 type StreamRequest struct {
 	Network     string
 	Destination M.Socksaddr
 	PacketAddr  bool
+	// ErrorCodes asks the server to include an ErrorCode in error responses.
+	// Servers that do not support it ignore it.
+	ErrorCodes bool
+	// PacketBatch switches UDP streams to batched packet framing, see PacketBatchWriter.
+	PacketBatch bool
 }
 
 func ReadStreamRequest(reader io.Reader) (*StreamRequest, error) {
@@ -137,7 +276,13 @@ func ReadStreamRequest(reader io.Reader) (*StreamRequest, error) {
 		network = N.NetworkUDP
 		udpAddr = flags&flagAddr != 0
 	}
-	return &StreamRequest{network, destination, udpAddr}, nil
+	return &StreamRequest{
+		Network:     network,
+		Destination: destination,
+		PacketAddr:  udpAddr,
+		ErrorCodes:  flags&flagErrorCode != 0,
+		PacketBatch: network == N.NetworkUDP && flags&flagPacketBatch != 0,
+	}, nil
 }
 
 func streamRequestLen(request StreamRequest) int {
@@ -160,12 +305,19 @@ func EncodeStreamRequest(request StreamRequest, buffer *buf.Buffer) error {
 			destination = Destination
 		}
 	}
+	if request.ErrorCodes {
+		flags |= flagErrorCode
+	}
+	if request.PacketBatch {
+		flags |= flagPacketBatch
+	}
 	common.Must(binary.Write(buffer, binary.BigEndian, flags))
 	return M.SocksaddrSerializer.WriteAddrPort(buffer, destination)
 }
 
 type StreamResponse struct {
 	Status  uint8
+	Code    ErrorCode
 	Message string
 }
 
@@ -175,7 +327,13 @@ func ReadStreamResponse(reader io.Reader) (*StreamResponse, error) {
 	if err != nil {
 		return nil, err
 	}
-	if response.Status == statusError {
+	if response.Status == statusErrorCode {
+		err = binary.Read(reader, binary.BigEndian, &response.Code)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if response.Status == statusError || response.Status == statusErrorCode {
 		response.Message, err = varbin.ReadValue[string](reader, binary.BigEndian)
 		if err != nil {
 			return nil, err
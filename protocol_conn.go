@@ -11,16 +11,19 @@ import (
 type protocolConn struct {
 	net.Conn
 	request        Request
+	psk            []byte
 	requestWritten bool
 }
 
-func newProtocolConn(conn net.Conn, request Request) net.Conn {
+// newProtocolConn authenticates the request with psk when it is written, if psk is not empty.
+func newProtocolConn(conn net.Conn, request Request, psk []byte) net.Conn {
 	writer, isVectorised := bufio.CreateVectorisedWriter(conn)
 	if isVectorised {
 		return &vectorisedProtocolConn{
 			protocolConn{
 				Conn:    conn,
 				request: request,
+				psk:     psk,
 			},
 			writer,
 		}
@@ -28,10 +31,18 @@ func newProtocolConn(conn net.Conn, request Request) net.Conn {
 		return &protocolConn{
 			Conn:    conn,
 			request: request,
+			psk:     psk,
 		}
 	}
 }
 
+func (c *protocolConn) encodeRequest(payload []byte) *buf.Buffer {
+	if len(c.psk) > 0 {
+		c.request.Authenticate(c.psk)
+	}
+	return EncodeRequest(c.request, payload)
+}
+
 func (c *protocolConn) NeedHandshake() bool {
 	return !c.requestWritten
 }
@@ -40,7 +51,7 @@ func (c *protocolConn) Write(p []byte) (n int, err error) {
 	if c.requestWritten {
 		return c.Conn.Write(p)
 	}
-	buffer := EncodeRequest(c.request, p)
+	buffer := c.encodeRequest(p)
 	n, err = c.Conn.Write(buffer.Bytes())
 	buffer.Release()
 	if err == nil {
@@ -64,6 +75,6 @@ func (c *vectorisedProtocolConn) WriteVectorised(buffers []*buf.Buffer) error {
 		return c.writer.WriteVectorised(buffers)
 	}
 	c.requestWritten = true
-	buffer := EncodeRequest(c.request, nil)
+	buffer := c.encodeRequest(nil)
 	return c.writer.WriteVectorised(append([]*buf.Buffer{buffer}, buffers...))
 }
@@ -0,0 +1,309 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	scheme := &PaddingScheme{Packets: 4, Lengths: []PaddingRange{{Min: 10, Max: 20}, {Min: 0, Max: 100}}}
+	shaping := &ShapingOptions{MinFrameSize: 100, MaxFrameSize: 1400, CoalesceDelay: 5 * time.Millisecond, CoverInterval: 2 * time.Second}
+	jitter := &JitterOptions{MinDelay: time.Millisecond, MaxDelay: 50 * time.Millisecond, Burst: 4}
+	for _, testCase := range []struct {
+		request  Request
+		expected Request
+	}{
+		{
+			Request{Version: Version0, Protocol: ProtocolSmux},
+			Request{Version: Version0, Protocol: ProtocolSmux},
+		},
+		{
+			Request{Version: Version1, Protocol: ProtocolYAMux, Padding: true},
+			Request{Version: Version1, Protocol: ProtocolYAMux, Padding: true},
+		},
+		{
+			Request{Version: Version2, Protocol: ProtocolH2Mux, Padding: true, PaddingScheme: scheme, Shaping: shaping, Jitter: jitter},
+			Request{Version: Version2, Protocol: ProtocolH2Mux, Padding: true, PaddingScheme: scheme, Shaping: shaping, Jitter: jitter},
+		},
+		{
+			Request{Version: Version2, Protocol: ProtocolSingMux, Padding: true, PaddingScheme: scheme},
+			Request{Version: Version2, Protocol: ProtocolSingMux, Padding: true, PaddingScheme: scheme},
+		},
+		{
+			// the padding scheme and shaping require padding
+			Request{Version: Version2, Protocol: ProtocolSingMux, PaddingScheme: scheme, Shaping: shaping, Jitter: jitter},
+			Request{Version: Version2, Protocol: ProtocolSingMux, Jitter: jitter},
+		},
+	} {
+		payload := []byte("payload")
+		buffer := EncodeRequest(testCase.request, payload)
+		reader := bytes.NewReader(buffer.Bytes())
+		decoded, err := ReadRequest(reader)
+		buffer.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*decoded, testCase.expected) {
+			t.Fatalf("request mismatch: %+v", *decoded)
+		}
+		remaining, _ := io.ReadAll(reader)
+		if !bytes.Equal(remaining, payload) {
+			t.Fatal("payload mismatch: ", remaining)
+		}
+	}
+}
+
+func TestRequestMalformed(t *testing.T) {
+	request := Request{
+		Version:       Version2,
+		Protocol:      ProtocolSingMux,
+		Padding:       true,
+		PaddingScheme: &PaddingScheme{Packets: 1, Lengths: []PaddingRange{{Min: 1, Max: 1}}},
+		Shaping:       &ShapingOptions{MinFrameSize: 100, MaxFrameSize: 200},
+		Jitter:        &JitterOptions{MaxDelay: time.Millisecond},
+	}
+	buffer := EncodeRequest(request, nil)
+	defer buffer.Release()
+	encoded := buffer.Bytes()
+	for truncated := 0; truncated < len(encoded); truncated++ {
+		_, err := ReadRequest(bytes.NewReader(encoded[:truncated]))
+		if err == nil {
+			t.Fatal("read request truncated to ", truncated, " bytes")
+		}
+	}
+	_, err := ReadRequest(bytes.NewReader([]byte{Version2 + 1, ProtocolSmux}))
+	if err == nil {
+		t.Fatal("read request of unsupported version")
+	}
+	// options follow the version, protocol and flags
+	schemeStart := 3
+	shapingStart := schemeStart + request.PaddingScheme.encodedLen()
+	jitterStart := shapingStart + shapingOptionsLen
+	for _, tamper := range []struct {
+		name   string
+		offset int
+		value  byte
+	}{
+		{"padding ranges count", schemeStart + 2, 0},
+		{"shaping min frame size", shapingStart + 1, 0},
+		{"jitter min delay", jitterStart, 0xff},
+	} {
+		tampered := append([]byte(nil), encoded...)
+		tampered[tamper.offset] = tamper.value
+		_, err = ReadRequest(bytes.NewReader(tampered))
+		if err == nil {
+			t.Fatal("read request with invalid ", tamper.name)
+		}
+	}
+}
+
+func TestShapingOptionsRoundTrip(t *testing.T) {
+	for _, options := range []ShapingOptions{
+		{MinFrameSize: 5, MaxFrameSize: 5},
+		{MinFrameSize: 100, MaxFrameSize: 65535, CoalesceDelay: time.Millisecond, CoverInterval: time.Hour},
+	} {
+		buffer := buf.NewSize(shapingOptionsLen)
+		options.writeTo(buffer)
+		if buffer.Len() != shapingOptionsLen {
+			t.Fatal("unexpected encoded length: ", buffer.Len())
+		}
+		decoded, err := readShapingOptions(bytes.NewReader(buffer.Bytes()))
+		buffer.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *decoded != options {
+			t.Fatalf("shaping options mismatch: %+v", *decoded)
+		}
+	}
+}
+
+func TestShapingOptionsMalformed(t *testing.T) {
+	for _, encoded := range [][]byte{
+		{0, 100, 1, 0, 0, 0, 0, 0, 0, 0, 0},
+		// frame sizes not above the header length
+		{0, 4, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0},
+		// min frame size above max
+		{0, 200, 0, 100, 0, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		_, err := readShapingOptions(bytes.NewReader(encoded))
+		if err == nil {
+			t.Fatal("read malformed shaping options: ", encoded)
+		}
+	}
+	for _, options := range []ShapingOptions{
+		{MinFrameSize: 100, MaxFrameSize: 65536},
+		{MinFrameSize: 100, MaxFrameSize: 200, CoalesceDelay: -1},
+		{MinFrameSize: 100, MaxFrameSize: 200, CoverInterval: -1},
+	} {
+		if options.Validate() == nil {
+			t.Fatalf("invalid shaping options validated: %+v", options)
+		}
+	}
+}
+
+func TestJitterOptionsRoundTrip(t *testing.T) {
+	for _, options := range []JitterOptions{
+		{},
+		{MinDelay: time.Millisecond, MaxDelay: 65535 * time.Millisecond, Burst: 65535},
+	} {
+		buffer := buf.NewSize(jitterOptionsLen)
+		options.writeTo(buffer)
+		if buffer.Len() != jitterOptionsLen {
+			t.Fatal("unexpected encoded length: ", buffer.Len())
+		}
+		decoded, err := readJitterOptions(bytes.NewReader(buffer.Bytes()))
+		buffer.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *decoded != options {
+			t.Fatalf("jitter options mismatch: %+v", *decoded)
+		}
+	}
+}
+
+func TestJitterOptionsMalformed(t *testing.T) {
+	for _, encoded := range [][]byte{
+		{0, 1, 0, 2, 0},
+		// min delay above max
+		{0, 2, 0, 1, 0, 0},
+	} {
+		_, err := readJitterOptions(bytes.NewReader(encoded))
+		if err == nil {
+			t.Fatal("read malformed jitter options: ", encoded)
+		}
+	}
+	for _, options := range []JitterOptions{
+		{MinDelay: -time.Millisecond, MaxDelay: time.Millisecond},
+		{MaxDelay: 65536 * time.Millisecond},
+		{MaxDelay: time.Millisecond, Burst: -1},
+		{MaxDelay: time.Millisecond, Burst: 65536},
+	} {
+		if options.Validate() == nil {
+			t.Fatalf("invalid jitter options validated: %+v", options)
+		}
+	}
+}
+
+func TestStreamRequestRoundTrip(t *testing.T) {
+	for _, testCase := range []struct {
+		request  StreamRequest
+		expected StreamRequest
+	}{
+		{
+			StreamRequest{Network: N.NetworkTCP, Destination: M.ParseSocksaddr("example.com:443"), ErrorCodes: true},
+			StreamRequest{Network: N.NetworkTCP, Destination: M.ParseSocksaddr("example.com:443"), ErrorCodes: true},
+		},
+		{
+			StreamRequest{Network: N.NetworkUDP, Destination: M.ParseSocksaddr("1.1.1.1:53"), PacketAddr: true, ErrorCodes: true, PacketBatch: true},
+			StreamRequest{Network: N.NetworkUDP, Destination: M.ParseSocksaddr("1.1.1.1:53"), PacketAddr: true, ErrorCodes: true, PacketBatch: true},
+		},
+		{
+			// batched packet framing only applies to UDP streams
+			StreamRequest{Network: N.NetworkTCP, Destination: M.ParseSocksaddr("1.1.1.1:80"), PacketBatch: true},
+			StreamRequest{Network: N.NetworkTCP, Destination: M.ParseSocksaddr("1.1.1.1:80")},
+		},
+	} {
+		buffer := buf.NewSize(streamRequestLen(testCase.request))
+		err := EncodeStreamRequest(testCase.request, buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := ReadStreamRequest(bytes.NewReader(buffer.Bytes()))
+		buffer.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Destination.String() != testCase.expected.Destination.String() {
+			t.Fatal("destination mismatch: ", decoded.Destination)
+		}
+		decoded.Destination = testCase.expected.Destination
+		if *decoded != testCase.expected {
+			t.Fatalf("stream request mismatch: %+v", *decoded)
+		}
+	}
+}
+
+func TestStreamResponseErrorCodes(t *testing.T) {
+	destination := M.ParseSocksaddr("example.com:443")
+	for _, testCase := range []struct {
+		err        error
+		errorCodes bool
+		status     uint8
+		code       ErrorCode
+		target     error
+	}{
+		{E.New("denied"), false, statusError, ErrorCodeGeneral, ErrRemote},
+		{WithErrorCode(E.New("denied"), ErrorCodeRejected), false, statusError, ErrorCodeGeneral, ErrRemote},
+		{WithErrorCode(E.New("denied"), ErrorCodeRejected), true, statusErrorCode, ErrorCodeRejected, ErrRemoteRejected},
+		{E.Cause(syscall.ECONNREFUSED, "dial"), true, statusErrorCode, ErrorCodeConnectionRefused, syscall.ECONNREFUSED},
+		{&net.DNSError{Err: "no such host", Name: "example.com"}, true, statusErrorCode, ErrorCodeDNSFailure, ErrRemoteDNSFailure},
+		{&RemoteError{Code: ErrorCodeGoingAway, Message: "going away"}, true, statusErrorCode, ErrorCodeGoingAway, ErrRemoteGoingAway},
+	} {
+		var buffer bytes.Buffer
+		err := writeStreamError(&buffer, testCase.err, testCase.errorCodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := ReadStreamResponse(&buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Status != testCase.status || response.Code != testCase.code || response.Message != testCase.err.Error() {
+			t.Fatalf("stream response mismatch: %+v", *response)
+		}
+		if buffer.Len() != 0 {
+			t.Fatal("unexpected trailing bytes: ", buffer.Len())
+		}
+		remoteErr := streamResponseError(response, destination)
+		if !errors.Is(remoteErr, testCase.target) {
+			t.Fatal("remote error ", remoteErr, " does not match ", testCase.target)
+		}
+	}
+	response, err := ReadStreamResponse(bytes.NewReader([]byte{statusSuccess}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamResponseError(response, destination) != nil {
+		t.Fatal("unexpected error of success response")
+	}
+}
+
+func TestStreamMalformed(t *testing.T) {
+	for _, encoded := range [][]byte{
+		{},
+		{statusError},
+		{statusError, 5, 'e'},
+		{statusErrorCode},
+		{statusErrorCode, byte(ErrorCodeRejected)},
+		{statusErrorCode, byte(ErrorCodeRejected), 5, 'e'},
+	} {
+		_, err := ReadStreamResponse(bytes.NewReader(encoded))
+		if err == nil {
+			t.Fatal("read malformed stream response: ", encoded)
+		}
+	}
+	request := StreamRequest{Network: N.NetworkUDP, Destination: M.ParseSocksaddr("example.com:443"), PacketAddr: true, ErrorCodes: true}
+	buffer := buf.NewSize(streamRequestLen(request))
+	defer buffer.Release()
+	common.Must(EncodeStreamRequest(request, buffer))
+	for truncated := 0; truncated < buffer.Len(); truncated++ {
+		_, err := ReadStreamRequest(bytes.NewReader(buffer.Bytes()[:truncated]))
+		if err == nil {
+			t.Fatal("read stream request truncated to ", truncated, " bytes")
+		}
+	}
+}
@@ -2,8 +2,13 @@ package mux
 
 import (
 	"context"
+	"math"
 	"net"
+	"net/netip"
+	"sync"
+	"time"
 
+	"github.com/sagernet/sing/common/atomic"
 	"github.com/sagernet/sing/common/bufio"
 	"github.com/sagernet/sing/common/debug"
 	E "github.com/sagernet/sing/common/exceptions"
@@ -27,12 +32,31 @@ type ServiceHandlerEx interface {
 }
 
 type Service struct {
-	newStreamContext func(context.Context, net.Conn) context.Context
-	logger           logger.ContextLogger
-	handler          ServiceHandler
-	handlerEx        ServiceHandlerEx
-	padding          bool
-	brutal           BrutalOptions
+	newStreamContext      func(context.Context, net.Conn) context.Context
+	logger                logger.ContextLogger
+	handler               ServiceHandler
+	handlerEx             ServiceHandlerEx
+	padding               bool
+	brutal                BrutalOptions
+	access                sync.Mutex
+	sessions              map[abstractSession]*sessionStats
+	shuttingDown          atomic.Bool
+	stats                 statsCounters
+	tracer                *Tracer
+	maxStreams            int
+	maxStreamRate         int
+	maxSessionsPerSource  int
+	sourceSessions        map[netip.Addr]int
+	refusals              chan struct{}
+	psk                   []byte
+	replayFilter          *replayFilter
+	maxPaddingPackets     int
+	maxPaddingLength      int
+	disableShaping        bool
+	minCoverInterval      time.Duration
+	maxShapingFrameSize   int
+	maxJitterDelay        time.Duration
+	smuxKeepAliveInterval time.Duration
 }
 
 type ServiceOptions struct {
@@ -42,20 +66,82 @@ type ServiceOptions struct {
 	HandlerEx        ServiceHandlerEx
 	Padding          bool
 	Brutal           BrutalOptions
+	Tracer           *Tracer
+	// MaxStreamsPerSession and MaxStreamRate limit the concurrent streams and the new streams per second
+	// of each session. Streams over the limits are refused with ErrorCodeRejected, or reset if that can not be done quickly.
+	MaxStreamsPerSession int
+	MaxStreamRate        int
+	// MaxSessionsPerSource limits the concurrent sessions from each source address.
+	MaxSessionsPerSource int
+	// PreSharedKey requires sessions to be authenticated with the same key, rejecting replayed requests.
+	// Authenticated requests are also accepted when it is empty.
+	PreSharedKey []byte
+	// MaxPaddingPackets and MaxPaddingLength bound the padding schemes announced by clients, which the service
+	// pads its own writes with. Sessions announcing larger schemes are rejected.
+	// Zero uses DefaultMaxPaddingPackets and DefaultMaxPaddingLength.
+	MaxPaddingPackets int
+	MaxPaddingLength  int
+	// DisableShaping rejects sessions requesting ShapingOptions. The shaping of the writes of other sessions
+	// is clamped to MinShapingCoverInterval and MaxShapingFrameSize, which clients read as usual.
+	// Zero uses DefaultMinShapingCoverInterval and DefaultMaxShapingFrameSize.
+	DisableShaping          bool
+	MinShapingCoverInterval time.Duration
+	MaxShapingFrameSize     int
+	// MaxJitterDelay clamps the delay of the jittered writes of the service. Zero uses DefaultMaxJitterDelay.
+	MaxJitterDelay time.Duration
+	// SmuxKeepAliveInterval sends NOP keepalives on smux sessions at this interval. Zero disables it.
+	// Clients with health checks evict smux sessions on which nothing arrives within their interval.
+	SmuxKeepAliveInterval time.Duration
 }
 
 func NewService(options ServiceOptions) (*Service, error) {
 	if options.Brutal.Enabled && !BrutalAvailable && !debug.Enabled {
 		return nil, E.New("TCP Brutal is only supported on Linux")
 	}
-	return &Service{
-		newStreamContext: options.NewStreamContext,
-		logger:           options.Logger,
-		handler:          options.Handler,
-		handlerEx:        options.HandlerEx,
-		padding:          options.Padding,
-		brutal:           options.Brutal,
-	}, nil
+	service := &Service{
+		newStreamContext:      options.NewStreamContext,
+		logger:                options.Logger,
+		handler:               options.Handler,
+		handlerEx:             options.HandlerEx,
+		padding:               options.Padding,
+		brutal:                options.Brutal,
+		tracer:                options.Tracer,
+		sessions:              make(map[abstractSession]*sessionStats),
+		maxStreams:            options.MaxStreamsPerSession,
+		maxStreamRate:         options.MaxStreamRate,
+		maxSessionsPerSource:  options.MaxSessionsPerSource,
+		sourceSessions:        make(map[netip.Addr]int),
+		refusals:              make(chan struct{}, maxStreamRefusals),
+		psk:                   options.PreSharedKey,
+		maxPaddingPackets:     options.MaxPaddingPackets,
+		maxPaddingLength:      options.MaxPaddingLength,
+		disableShaping:        options.DisableShaping,
+		minCoverInterval:      options.MinShapingCoverInterval,
+		maxShapingFrameSize:   options.MaxShapingFrameSize,
+		maxJitterDelay:        options.MaxJitterDelay,
+		smuxKeepAliveInterval: options.SmuxKeepAliveInterval,
+	}
+	if service.maxPaddingPackets <= 0 {
+		service.maxPaddingPackets = DefaultMaxPaddingPackets
+	}
+	if service.maxPaddingLength <= 0 {
+		service.maxPaddingLength = DefaultMaxPaddingLength
+	}
+	if service.minCoverInterval <= 0 {
+		service.minCoverInterval = DefaultMinShapingCoverInterval
+	}
+	if service.maxShapingFrameSize <= 0 {
+		service.maxShapingFrameSize = DefaultMaxShapingFrameSize
+	} else if service.maxShapingFrameSize <= 4 || service.maxShapingFrameSize > math.MaxUint16 {
+		return nil, E.New("invalid max shaping frame size: ", service.maxShapingFrameSize)
+	}
+	if service.maxJitterDelay <= 0 {
+		service.maxJitterDelay = DefaultMaxJitterDelay
+	}
+	if len(service.psk) > 0 {
+		service.replayFilter = newReplayFilter()
+	}
+	return service, nil
 }
 
 // Deprecated: Use NewConnectionEx instead.
@@ -72,19 +158,78 @@ func (s *Service) NewConnectionEx(ctx context.Context, conn net.Conn, source M.S
 }
 
 func (s *Service) newConnection(ctx context.Context, conn net.Conn, source M.Socksaddr) error {
+	if s.shuttingDown.Load() {
+		s.stats.addHandshakeFailure(HandshakeFailureShutdown)
+		return E.New("service is shutting down")
+	}
+	if !s.acquireSource(source) {
+		s.stats.addHandshakeFailure(HandshakeFailureLimit)
+		return E.New("too many sessions from ", source.Unwrap().Addr)
+	}
+	defer s.releaseSource(source)
 	request, err := ReadRequest(conn)
 	if err != nil {
+		s.stats.addHandshakeFailure(HandshakeFailureRequest)
 		return err
 	}
+	if len(s.psk) > 0 {
+		err = request.Verify(s.psk)
+		if err == nil && !s.replayFilter.check(request.Auth) {
+			err = E.New("replayed request")
+		}
+		if err != nil {
+			s.stats.addHandshakeFailure(HandshakeFailureAuth)
+			return E.Cause(err, "authenticate multiplex session")
+		}
+	}
+	remoteAddr := conn.RemoteAddr()
+	if source.IsValid() {
+		remoteAddr = source
+	}
+	stats := newSessionStats(&s.stats, request.Protocol, request.Padding, conn.LocalAddr(), remoteAddr)
+	if request.PaddingScheme != nil {
+		err = s.checkPaddingScheme(request.PaddingScheme)
+		if err != nil {
+			s.stats.addHandshakeFailure(HandshakeFailurePadding)
+			return err
+		}
+	}
 	if request.Padding {
-		conn = newPaddingConn(conn)
+		if request.Shaping != nil {
+			if s.disableShaping {
+				s.stats.addHandshakeFailure(HandshakeFailurePadding)
+				return E.New("shaping is disabled")
+			}
+			conn = newShapingConn(conn, s.clampShapingOptions(request.Shaping), stats.addPaddingOverhead)
+		} else {
+			conn = newPaddingConn(conn, request.Version, request.PaddingScheme, stats.addPaddingOverhead)
+		}
 	} else if s.padding {
+		s.stats.addHandshakeFailure(HandshakeFailurePadding)
 		return E.New("non-padded connection rejected")
 	}
-	session, err := newServerSession(conn, request.Protocol)
+	if request.Jitter != nil {
+		conn = newJitterConn(conn, s.clampJitterOptions(request.Jitter))
+	}
+	session, err := newServerSession(conn, request.Protocol, s.smuxKeepAliveInterval)
 	if err != nil {
+		s.stats.addHandshakeFailure(HandshakeFailureSession)
+		conn.Close()
 		return err
 	}
+	s.tracer.sessionEstablished(request.Protocol)
+	s.access.Lock()
+	s.sessions[session] = stats
+	s.access.Unlock()
+	defer func() {
+		s.access.Lock()
+		delete(s.sessions, session)
+		s.access.Unlock()
+	}()
+	var rateLimiter *streamRateLimiter
+	if s.maxStreamRate > 0 {
+		rateLimiter = newStreamRateLimiter(s.maxStreamRate)
+	}
 	var group task.Group
 	group.Append0(func(_ context.Context) error {
 		for {
@@ -92,9 +237,16 @@ func (s *Service) newConnection(ctx context.Context, conn net.Conn, source M.Soc
 			if aErr != nil {
 				return aErr
 			}
+			limitErr := s.checkStreamLimits(session, rateLimiter)
+			if limitErr != nil {
+				s.stats.addHandshakeFailure(HandshakeFailureLimit)
+				s.refuseStream(stream, limitErr)
+				s.logger.DebugContext(ctx, E.Cause(limitErr, "refuse multiplex stream"))
+				continue
+			}
 			streamCtx := s.newStreamContext(ctx, stream)
 			go func() {
-				hErr := s.newSession(streamCtx, conn, stream, source)
+				hErr := s.newSession(streamCtx, conn, stream, source, stats)
 				if hErr != nil {
 					stream.Close()
 					s.logger.ErrorContext(streamCtx, E.Cause(hErr, "process multiplex stream"))
@@ -105,18 +257,29 @@ func (s *Service) newConnection(ctx context.Context, conn net.Conn, source M.Soc
 	group.Cleanup(func() {
 		session.Close()
 	})
-	return group.Run(ctx)
+	err = group.Run(ctx)
+	s.tracer.sessionClosed(err)
+	return err
 }
 
-func (s *Service) newSession(ctx context.Context, sessionConn net.Conn, stream net.Conn, source M.Socksaddr) error {
+func (s *Service) newSession(ctx context.Context, sessionConn net.Conn, stream net.Conn, source M.Socksaddr, stats *sessionStats) error {
 	stream = &wrapStream{stream}
 	request, err := ReadStreamRequest(stream)
 	if err != nil {
+		s.stats.addHandshakeFailure(HandshakeFailureStreamRequest)
 		return E.Cause(err, "read multiplex stream request")
 	}
+	if s.shuttingDown.Load() {
+		s.stats.addHandshakeFailure(HandshakeFailureShutdown)
+		return rejectStream(stream, request, E.New("service is shutting down"), ErrorCodeGoingAway)
+	}
 	destination := request.Destination
+	if destination.Fqdn != BrutalExchangeDomain {
+		stream = newStatsStream(stream, stats)
+		s.tracer.streamOpen(destination, request.Network)
+	}
 	if request.Network == N.NetworkTCP {
-		conn := &serverConn{ExtendedConn: bufio.NewExtendedConn(stream)}
+		conn := newServerConn(stream, request.ErrorCodes)
 		if request.Destination.Fqdn == BrutalExchangeDomain {
 			defer stream.Close()
 			var clientReceiveBPS uint64
@@ -146,6 +309,10 @@ func (s *Service) newSession(ctx context.Context, sessionConn net.Conn, stream n
 					return nil
 				}
 			}
+			if err == nil {
+				stats.brutalSendBPS.Store(sendBPS)
+				s.tracer.brutalNegotiated(sendBPS)
+			}
 			err = WriteBrutalResponse(conn, s.brutal.ReceiveBPS, true, "")
 			if err != nil {
 				return E.Cause(err, "write brutal response")
@@ -163,10 +330,19 @@ func (s *Service) newSession(ctx context.Context, sessionConn net.Conn, stream n
 		var packetConn N.PacketConn
 		if !request.PacketAddr {
 			s.logger.InfoContext(ctx, "inbound multiplex packet connection to ", destination)
-			packetConn = &serverPacketConn{ExtendedConn: bufio.NewExtendedConn(stream), destination: request.Destination}
+			packetConn = &serverPacketConn{
+				ExtendedConn: bufio.NewExtendedConn(stream),
+				destination:  request.Destination,
+				framing:      packetFraming{batch: request.PacketBatch},
+				errorCodes:   request.ErrorCodes,
+			}
 		} else {
 			s.logger.InfoContext(ctx, "inbound multiplex packet connection")
-			packetConn = &serverPacketAddrConn{ExtendedConn: bufio.NewExtendedConn(stream)}
+			packetConn = &serverPacketAddrConn{
+				ExtendedConn: bufio.NewExtendedConn(stream),
+				framing:      packetFraming{addr: true, batch: request.PacketBatch},
+				errorCodes:   request.ErrorCodes,
+			}
 		}
 		if s.handler != nil {
 			//nolint:staticcheck
@@ -177,3 +353,43 @@ func (s *Service) newSession(ctx context.Context, sessionConn net.Conn, stream n
 	}
 	return nil
 }
+
+func rejectStream(stream net.Conn, request *StreamRequest, err error, code ErrorCode) error {
+	conn := &serverConn{ExtendedConn: bufio.NewExtendedConn(stream), errorCodes: request.ErrorCodes}
+	return E.Errors(err, N.ReportHandshakeFailure(conn, WithErrorCode(err, code)))
+}
+
+// Stats returns a snapshot of the sessions currently served.
+func (s *Service) Stats() Stats {
+	s.access.Lock()
+	defer s.access.Unlock()
+	stats := s.stats.snapshot()
+	for session, sessionStats := range s.sessions {
+		stats.Sessions = append(stats.Sessions, sessionStats.snapshot(session))
+	}
+	return stats
+}
+
+// Shutdown stops accepting new sessions and streams, and waits for the streams of existing sessions to finish,
+// then closes all sessions. Sessions are closed immediately once ctx is done.
+// New streams are rejected with ErrorCodeGoingAway.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.shuttingDown.Store(true)
+	s.access.Lock()
+	sessions := make([]abstractSession, 0, len(s.sessions))
+	for session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.access.Unlock()
+	for _, session := range sessions {
+		err := session.Shutdown()
+		if err != nil {
+			s.logger.Debug(E.Cause(err, "shutdown multiplex session"))
+		}
+	}
+	err := waitSessionsIdle(ctx, sessions)
+	for _, session := range sessions {
+		session.Close()
+	}
+	return err
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
 	"github.com/sagernet/sing/common/varbin"
@@ -15,22 +16,46 @@ import (
 
 type serverConn struct {
 	N.ExtendedConn
+	errorCodes      bool
 	responseWritten bool
+	readWaitOptions N.ReadWaitOptions
+	readWaiter      N.ReadWaiter
 }
 
 func (c *serverConn) NeedHandshake() bool {
 	return !c.responseWritten
 }
 
+func (c *serverConn) HandshakeSuccess() error {
+	if c.responseWritten {
+		return nil
+	}
+	_, err := c.ExtendedConn.Write([]byte{statusSuccess})
+	if err != nil {
+		return err
+	}
+	c.responseWritten = true
+	return nil
+}
+
 func (c *serverConn) HandshakeFailure(err error) error {
+	return writeStreamError(c.ExtendedConn, err, c.errorCodes)
+}
+
+func writeStreamError(writer io.Writer, err error, errorCodes bool) error {
 	errMessage := err.Error()
-	buffer := buf.NewSize(1 + varbin.UvarintLen(uint64(len(errMessage))) + len(errMessage))
+	buffer := buf.NewSize(2 + varbin.UvarintLen(uint64(len(errMessage))) + len(errMessage))
 	defer buffer.Release()
-	common.Must(
-		buffer.WriteByte(statusError),
-		varbin.Write(buffer, binary.BigEndian, errMessage),
-	)
-	return common.Error(c.ExtendedConn.Write(buffer.Bytes()))
+	if errorCodes {
+		common.Must(
+			buffer.WriteByte(statusErrorCode),
+			buffer.WriteByte(byte(errorCodeOf(err))),
+		)
+	} else {
+		common.Must(buffer.WriteByte(statusError))
+	}
+	common.Must(varbin.Write(buffer, binary.BigEndian, errMessage))
+	return common.Error(writer.Write(buffer.Bytes()))
 }
 
 func (c *serverConn) Write(b []byte) (n int, err error) {
@@ -75,35 +100,74 @@ func (c *serverConn) Upstream() any {
 	return c.ExtendedConn
 }
 
+func (c *serverConn) SessionInfo() SessionInfo {
+	return sessionInfoOf(c.ExtendedConn)
+}
+
+func (c *serverConn) Reset(code ErrorCode) error {
+	return resetStream(c.ExtendedConn, code)
+}
+
+// halfCloseServerConn is the serverConn of a stream that can be half-closed.
+type halfCloseServerConn struct {
+	*serverConn
+}
+
+func newServerConn(stream net.Conn, errorCodes bool) net.Conn {
+	conn := &serverConn{ExtendedConn: bufio.NewExtendedConn(stream), errorCodes: errorCodes}
+	if canCloseWrite(stream) {
+		return &halfCloseServerConn{conn}
+	}
+	return conn
+}
+
+func (c *halfCloseServerConn) CloseWrite() error {
+	err := c.HandshakeSuccess()
+	if err != nil {
+		return err
+	}
+	return N.CloseWrite(c.ExtendedConn)
+}
+
 type serverPacketConn struct {
 	N.ExtendedConn
 	access          sync.Mutex
 	destination     M.Socksaddr
+	framing         packetFraming
+	errorCodes      bool
 	responseWritten bool
+	readWaitOptions N.ReadWaitOptions
 }
 
 func (c *serverPacketConn) NeedHandshake() bool {
 	return !c.responseWritten
 }
 
+func (c *serverPacketConn) HandshakeSuccess() error {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.responseWritten {
+		return nil
+	}
+	_, err := c.ExtendedConn.Write([]byte{statusSuccess})
+	if err != nil {
+		return err
+	}
+	c.responseWritten = true
+	return nil
+}
+
 func (c *serverPacketConn) HandshakeFailure(err error) error {
-	errMessage := err.Error()
-	buffer := buf.NewSize(1 + varbin.UvarintLen(uint64(len(errMessage))) + len(errMessage))
-	defer buffer.Release()
-	common.Must(
-		buffer.WriteByte(statusError),
-		varbin.Write(buffer, binary.BigEndian, errMessage),
-	)
-	return common.Error(c.ExtendedConn.Write(buffer.Bytes()))
+	return writeStreamError(c.ExtendedConn, err, c.errorCodes)
 }
 
 func (c *serverPacketConn) ReadPacket(buffer *buf.Buffer) (destination M.Socksaddr, err error) {
-	var length uint16
-	err = binary.Read(c.ExtendedConn, binary.BigEndian, &length)
+	var length int
+	_, length, err = c.framing.readHeader(c.ExtendedConn)
 	if err != nil {
 		return
 	}
-	_, err = buffer.ReadFullFrom(c.ExtendedConn, int(length))
+	_, err = buffer.ReadFullFrom(c.ExtendedConn, length)
 	if err != nil {
 		return
 	}
@@ -113,27 +177,54 @@ func (c *serverPacketConn) ReadPacket(buffer *buf.Buffer) (destination M.Socksad
 
 func (c *serverPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
 	pLen := buffer.Len()
-	common.Must(binary.Write(buf.With(buffer.ExtendHeader(2)), binary.BigEndian, uint16(pLen)))
+	err := c.framing.writeHeader(buf.With(buffer.ExtendHeader(c.framing.singleHeaderLen(M.Socksaddr{}))), M.Socksaddr{}, pLen)
+	if err != nil {
+		buffer.Release()
+		return err
+	}
 	if !c.responseWritten {
 		c.access.Lock()
 		if c.responseWritten {
 			c.access.Unlock()
 		} else {
 			defer c.access.Unlock()
+			buffer.ExtendHeader(1)[0] = statusSuccess
+			c.responseWritten = true
 		}
-		buffer.ExtendHeader(1)[0] = statusSuccess
-		c.responseWritten = true
 	}
 	return c.ExtendedConn.WriteBuffer(buffer)
 }
 
+func (c *serverPacketConn) WritePacketBatch(buffers []*buf.Buffer, destinations []M.Socksaddr) error {
+	if !c.framing.batch {
+		for i, buffer := range buffers {
+			err := c.WritePacket(buffer, M.Socksaddr{})
+			if err != nil {
+				buf.ReleaseMulti(buffers[i+1:])
+				return err
+			}
+		}
+		return nil
+	}
+	batch, err := c.framing.encodeBatch(buffers, destinations)
+	if err != nil {
+		return err
+	}
+	defer batch.Release()
+	err = c.HandshakeSuccess()
+	if err != nil {
+		return err
+	}
+	return common.Error(c.ExtendedConn.Write(batch.Bytes()))
+}
+
 func (c *serverPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	var length uint16
-	err = binary.Read(c.ExtendedConn, binary.BigEndian, &length)
+	var length int
+	_, length, err = c.framing.readHeader(c.ExtendedConn)
 	if err != nil {
 		return
 	}
-	if cap(p) < int(length) {
+	if cap(p) < length {
 		return 0, nil, io.ErrShortBuffer
 	}
 	n, err = io.ReadFull(c.ExtendedConn, p[:length])
@@ -154,13 +245,23 @@ func (c *serverPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 			c.responseWritten = true
 		}
 	}
-	err = binary.Write(c.ExtendedConn, binary.BigEndian, uint16(len(p)))
+	err = c.writeHeader(len(p))
 	if err != nil {
 		return
 	}
 	return c.ExtendedConn.Write(p)
 }
 
+func (c *serverPacketConn) writeHeader(length int) error {
+	header := buf.NewSize(c.framing.singleHeaderLen(M.Socksaddr{}))
+	defer header.Release()
+	err := c.framing.writeHeader(header, M.Socksaddr{}, length)
+	if err != nil {
+		return err
+	}
+	return common.Error(c.ExtendedConn.Write(header.Bytes()))
+}
+
 func (c *serverPacketConn) NeedAdditionalReadDeadline() bool {
 	return true
 }
@@ -169,36 +270,54 @@ func (c *serverPacketConn) Upstream() any {
 	return c.ExtendedConn
 }
 
+func (c *serverPacketConn) SessionInfo() SessionInfo {
+	return sessionInfoOf(c.ExtendedConn)
+}
+
+func (c *serverPacketConn) Reset(code ErrorCode) error {
+	return resetStream(c.ExtendedConn, code)
+}
+
 func (c *serverPacketConn) FrontHeadroom() int {
 	if !c.responseWritten {
-		return 3
+		return 1 + c.framing.frontHeadroom()
 	}
-	return 2
+	return c.framing.frontHeadroom()
 }
 
 type serverPacketAddrConn struct {
 	N.ExtendedConn
 	access          sync.Mutex
+	framing         packetFraming
+	errorCodes      bool
 	responseWritten bool
+	readWaitOptions N.ReadWaitOptions
 }
 
 func (c *serverPacketAddrConn) NeedHandshake() bool {
 	return !c.responseWritten
 }
 
+func (c *serverPacketAddrConn) HandshakeSuccess() error {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.responseWritten {
+		return nil
+	}
+	_, err := c.ExtendedConn.Write([]byte{statusSuccess})
+	if err != nil {
+		return err
+	}
+	c.responseWritten = true
+	return nil
+}
+
 func (c *serverPacketAddrConn) HandshakeFailure(err error) error {
-	errMessage := err.Error()
-	buffer := buf.NewSize(1 + varbin.UvarintLen(uint64(len(errMessage))) + len(errMessage))
-	defer buffer.Release()
-	common.Must(
-		buffer.WriteByte(statusError),
-		varbin.Write(buffer, binary.BigEndian, errMessage),
-	)
-	return common.Error(c.ExtendedConn.Write(buffer.Bytes()))
+	return writeStreamError(c.ExtendedConn, err, c.errorCodes)
 }
 
 func (c *serverPacketAddrConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	destination, err := M.SocksaddrSerializer.ReadAddrPort(c.ExtendedConn)
+	destination, length, err := c.framing.readHeader(c.ExtendedConn)
 	if err != nil {
 		return
 	}
@@ -207,12 +326,7 @@ func (c *serverPacketAddrConn) ReadFrom(p []byte) (n int, addr net.Addr, err err
 	} else {
 		addr = destination.UDPAddr()
 	}
-	var length uint16
-	err = binary.Read(c.ExtendedConn, binary.BigEndian, &length)
-	if err != nil {
-		return
-	}
-	if cap(p) < int(length) {
+	if cap(p) < length {
 		return 0, nil, io.ErrShortBuffer
 	}
 	n, err = io.ReadFull(c.ExtendedConn, p[:length])
@@ -233,11 +347,14 @@ func (c *serverPacketAddrConn) WriteTo(p []byte, addr net.Addr) (n int, err erro
 			c.responseWritten = true
 		}
 	}
-	err = M.SocksaddrSerializer.WriteAddrPort(c.ExtendedConn, M.SocksaddrFromNet(addr))
+	destination := M.SocksaddrFromNet(addr)
+	header := buf.NewSize(c.framing.singleHeaderLen(destination))
+	defer header.Release()
+	err = c.framing.writeHeader(header, destination, len(p))
 	if err != nil {
 		return
 	}
-	err = binary.Write(c.ExtendedConn, binary.BigEndian, uint16(len(p)))
+	_, err = c.ExtendedConn.Write(header.Bytes())
 	if err != nil {
 		return
 	}
@@ -245,16 +362,12 @@ func (c *serverPacketAddrConn) WriteTo(p []byte, addr net.Addr) (n int, err erro
 }
 
 func (c *serverPacketAddrConn) ReadPacket(buffer *buf.Buffer) (destination M.Socksaddr, err error) {
-	destination, err = M.SocksaddrSerializer.ReadAddrPort(c.ExtendedConn)
+	var length int
+	destination, length, err = c.framing.readHeader(c.ExtendedConn)
 	if err != nil {
 		return
 	}
-	var length uint16
-	err = binary.Read(c.ExtendedConn, binary.BigEndian, &length)
-	if err != nil {
-		return
-	}
-	_, err = buffer.ReadFullFrom(c.ExtendedConn, int(length))
+	_, err = buffer.ReadFullFrom(c.ExtendedConn, length)
 	if err != nil {
 		return
 	}
@@ -263,9 +376,9 @@ func (c *serverPacketAddrConn) ReadPacket(buffer *buf.Buffer) (destination M.Soc
 
 func (c *serverPacketAddrConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
 	pLen := buffer.Len()
-	common.Must(binary.Write(buf.With(buffer.ExtendHeader(2)), binary.BigEndian, uint16(pLen)))
-	err := M.SocksaddrSerializer.WriteAddrPort(buf.With(buffer.ExtendHeader(M.SocksaddrSerializer.AddrPortLen(destination))), destination)
+	err := c.framing.writeHeader(buf.With(buffer.ExtendHeader(c.framing.singleHeaderLen(destination))), destination, pLen)
 	if err != nil {
+		buffer.Release()
 		return err
 	}
 	if !c.responseWritten {
@@ -281,6 +394,29 @@ func (c *serverPacketAddrConn) WritePacket(buffer *buf.Buffer, destination M.Soc
 	return c.ExtendedConn.WriteBuffer(buffer)
 }
 
+func (c *serverPacketAddrConn) WritePacketBatch(buffers []*buf.Buffer, destinations []M.Socksaddr) error {
+	if !c.framing.batch {
+		for i, buffer := range buffers {
+			err := c.WritePacket(buffer, destinations[i])
+			if err != nil {
+				buf.ReleaseMulti(buffers[i+1:])
+				return err
+			}
+		}
+		return nil
+	}
+	batch, err := c.framing.encodeBatch(buffers, destinations)
+	if err != nil {
+		return err
+	}
+	defer batch.Release()
+	err = c.HandshakeSuccess()
+	if err != nil {
+		return err
+	}
+	return common.Error(c.ExtendedConn.Write(batch.Bytes()))
+}
+
 func (c *serverPacketAddrConn) NeedAdditionalReadDeadline() bool {
 	return true
 }
@@ -289,9 +425,17 @@ func (c *serverPacketAddrConn) Upstream() any {
 	return c.ExtendedConn
 }
 
+func (c *serverPacketAddrConn) SessionInfo() SessionInfo {
+	return sessionInfoOf(c.ExtendedConn)
+}
+
+func (c *serverPacketAddrConn) Reset(code ErrorCode) error {
+	return resetStream(c.ExtendedConn, code)
+}
+
 func (c *serverPacketAddrConn) FrontHeadroom() int {
 	if !c.responseWritten {
-		return 3 + M.MaxSocksaddrLength
+		return 1 + c.framing.frontHeadroom()
 	}
-	return 2 + M.MaxSocksaddrLength
+	return c.framing.frontHeadroom()
 }
@@ -0,0 +1,74 @@
+package mux
+
+import (
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+var _ N.ReadWaiter = (*serverConn)(nil)
+
+// InitializeReadWaiter passes reads through to the read waiter of the stream, if the protocol has one.
+func (c *serverConn) InitializeReadWaiter(options N.ReadWaitOptions) (needCopy bool) {
+	c.readWaitOptions = options
+	c.readWaiter, _ = bufio.CreateReadWaiter(c.ExtendedConn)
+	if c.readWaiter != nil {
+		return c.readWaiter.InitializeReadWaiter(options)
+	}
+	return false
+}
+
+func (c *serverConn) WaitReadBuffer() (buffer *buf.Buffer, err error) {
+	if c.readWaiter != nil {
+		return c.readWaiter.WaitReadBuffer()
+	}
+	return waitReadBuffer(c.ExtendedConn, c.readWaitOptions)
+}
+
+var _ N.PacketReadWaiter = (*serverPacketConn)(nil)
+
+func (c *serverPacketConn) InitializeReadWaiter(options N.ReadWaitOptions) (needCopy bool) {
+	c.readWaitOptions = options
+	return false
+}
+
+func (c *serverPacketConn) WaitReadPacket() (buffer *buf.Buffer, destination M.Socksaddr, err error) {
+	var length int
+	_, length, err = c.framing.readHeader(c.ExtendedConn)
+	if err != nil {
+		return
+	}
+	buffer = newPacketBuffer(c.readWaitOptions, length)
+	_, err = buffer.ReadFullFrom(c.ExtendedConn, length)
+	if err != nil {
+		buffer.Release()
+		return nil, M.Socksaddr{}, err
+	}
+	c.readWaitOptions.PostReturn(buffer)
+	destination = c.destination
+	return
+}
+
+var _ N.PacketReadWaiter = (*serverPacketAddrConn)(nil)
+
+func (c *serverPacketAddrConn) InitializeReadWaiter(options N.ReadWaitOptions) (needCopy bool) {
+	c.readWaitOptions = options
+	return false
+}
+
+func (c *serverPacketAddrConn) WaitReadPacket() (buffer *buf.Buffer, destination M.Socksaddr, err error) {
+	var length int
+	destination, length, err = c.framing.readHeader(c.ExtendedConn)
+	if err != nil {
+		return
+	}
+	buffer = newPacketBuffer(c.readWaitOptions, length)
+	_, err = buffer.ReadFullFrom(c.ExtendedConn, length)
+	if err != nil {
+		buffer.Release()
+		return nil, M.Socksaddr{}, err
+	}
+	c.readWaitOptions.PostReturn(buffer)
+	return
+}
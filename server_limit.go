@@ -0,0 +1,151 @@
+package mux
+
+import (
+	"net"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// streamRateLimiter is a token bucket allowing rate streams per second with bursts of rate.
+// It is only used from the accept loop of a session, so it is not safe for concurrent use.
+type streamRateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newStreamRateLimiter(rate int) *streamRateLimiter {
+	return &streamRateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (l *streamRateLimiter) allow() bool {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+const (
+	// maxStreamRefusals bounds the streams over the limits being refused at once, further ones are reset.
+	maxStreamRefusals   = 16
+	streamRefuseTimeout = time.Second
+)
+
+// refuseStream answers the request of a stream over the limits with ErrorCodeRejected,
+// and resets the stream if the request or the response does not make it within streamRefuseTimeout.
+func (s *Service) refuseStream(stream net.Conn, limitErr error) {
+	select {
+	case s.refusals <- struct{}{}:
+	default:
+		resetStream(stream, ErrorCodeRejected)
+		return
+	}
+	go func() {
+		defer func() {
+			<-s.refusals
+		}()
+		wrappedStream := &wrapStream{stream}
+		_ = stream.SetDeadline(time.Now().Add(streamRefuseTimeout))
+		request, err := ReadStreamRequest(wrappedStream)
+		if err == nil {
+			err = writeStreamError(wrappedStream, WithErrorCode(limitErr, ErrorCodeRejected), request.ErrorCodes)
+		}
+		if err != nil {
+			resetStream(stream, ErrorCodeRejected)
+			return
+		}
+		stream.Close()
+	}()
+}
+
+func (s *Service) checkStreamLimits(session abstractSession, rateLimiter *streamRateLimiter) error {
+	// the accepted stream is already counted
+	if s.maxStreams > 0 && session.NumStreams() > s.maxStreams {
+		return E.New("too many concurrent streams")
+	}
+	if rateLimiter != nil && !rateLimiter.allow() {
+		return E.New("stream rate limit exceeded")
+	}
+	return nil
+}
+
+// checkPaddingScheme bounds the padding of the writes of the service, as it pads with the scheme of the client.
+func (s *Service) checkPaddingScheme(scheme *PaddingScheme) error {
+	if scheme.Packets > s.maxPaddingPackets {
+		return E.New("too many padding packets: ", scheme.Packets)
+	}
+	for _, paddingRange := range scheme.Lengths {
+		if paddingRange.Max > s.maxPaddingLength {
+			return E.New("padding too long: ", paddingRange.Max)
+		}
+	}
+	return nil
+}
+
+// clampShapingOptions bounds the cover traffic and frame size of the writes of the service,
+// as it shapes with the options of the client.
+func (s *Service) clampShapingOptions(options *ShapingOptions) *ShapingOptions {
+	clamped := *options
+	if clamped.MaxFrameSize > s.maxShapingFrameSize {
+		clamped.MaxFrameSize = s.maxShapingFrameSize
+		if clamped.MinFrameSize > clamped.MaxFrameSize {
+			clamped.MinFrameSize = clamped.MaxFrameSize
+		}
+	}
+	if clamped.CoverInterval > 0 && clamped.CoverInterval < s.minCoverInterval {
+		clamped.CoverInterval = s.minCoverInterval
+	}
+	return &clamped
+}
+
+// clampJitterOptions bounds the delay of the writes of the service, as it schedules them with the options of the client.
+func (s *Service) clampJitterOptions(options *JitterOptions) *JitterOptions {
+	clamped := *options
+	if clamped.MaxDelay > s.maxJitterDelay {
+		clamped.MaxDelay = s.maxJitterDelay
+		if clamped.MinDelay > clamped.MaxDelay {
+			clamped.MinDelay = clamped.MaxDelay
+		}
+	}
+	return &clamped
+}
+
+func (s *Service) acquireSource(source M.Socksaddr) bool {
+	if s.maxSessionsPerSource <= 0 || !source.IsIP() {
+		return true
+	}
+	s.access.Lock()
+	defer s.access.Unlock()
+	addr := source.Unwrap().Addr
+	if s.sourceSessions[addr] >= s.maxSessionsPerSource {
+		return false
+	}
+	s.sourceSessions[addr]++
+	return true
+}
+
+func (s *Service) releaseSource(source M.Socksaddr) {
+	if s.maxSessionsPerSource <= 0 || !source.IsIP() {
+		return
+	}
+	s.access.Lock()
+	defer s.access.Unlock()
+	addr := source.Unwrap().Addr
+	s.sourceSessions[addr]--
+	if s.sourceSessions[addr] == 0 {
+		delete(s.sourceSessions, addr)
+	}
+}
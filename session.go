@@ -1,11 +1,18 @@
 package mux
 
 import (
+	"context"
 	"io"
+	"math"
 	"net"
+	"os"
 	"reflect"
+	"time"
 
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/atomic"
 	E "github.com/sagernet/sing/common/exceptions"
+	N "github.com/sagernet/sing/common/network"
 	"github.com/sagernet/smux"
 
 	"github.com/hashicorp/yamux"
@@ -18,9 +25,14 @@ type abstractSession interface {
 	Close() error
 	IsClosed() bool
 	CanTakeNewRequest() bool
+	// Ping returns os.ErrInvalid if the protocol has no round-trip probe.
+	Ping() (time.Duration, error)
+	// Shutdown stops the session from taking new streams, notifying the peer where the protocol allows it.
+	// Existing streams are left running.
+	Shutdown() error
 }
 
-func newClientSession(conn net.Conn, protocol byte) (abstractSession, error) {
+func newClientSession(conn net.Conn, protocol byte, healthCheck HealthCheckOptions) (abstractSession, error) {
 	switch protocol {
 	case ProtocolH2Mux:
 		session, err := newH2MuxClient(conn)
@@ -29,45 +41,79 @@ func newClientSession(conn net.Conn, protocol byte) (abstractSession, error) {
 		}
 		return session, nil
 	case ProtocolSmux:
-		client, err := smux.Client(conn, smuxConfig())
+		session := &smuxSession{probeInterval: healthCheck.Interval}
+		if healthCheck.Interval > 0 {
+			session.activity = newActivityConn(conn)
+			conn = session.activity
+		}
+		client, err := smux.Client(conn, smuxClientConfig(healthCheck))
 		if err != nil {
 			return nil, err
 		}
-		return &smuxSession{client}, nil
+		session.Session = client
+		return session, nil
 	case ProtocolYAMux:
 		checkYAMuxConn(conn)
 		client, err := yamux.Client(conn, yaMuxConfig())
 		if err != nil {
 			return nil, err
 		}
-		return &yamuxSession{client}, nil
+		return &yamuxSession{Session: client}, nil
+	case ProtocolSingMux:
+		return newSingMuxSession(conn, true), nil
 	default:
 		return nil, E.New("unexpected protocol ", protocol)
 	}
 }
 
-func newServerSession(conn net.Conn, protocol byte) (abstractSession, error) {
+func newServerSession(conn net.Conn, protocol byte, smuxKeepAliveInterval time.Duration) (abstractSession, error) {
 	switch protocol {
 	case ProtocolH2Mux:
 		return newH2MuxServer(conn), nil
 	case ProtocolSmux:
-		client, err := smux.Server(conn, smuxConfig())
+		client, err := smux.Server(conn, smuxServerConfig(smuxKeepAliveInterval))
 		if err != nil {
 			return nil, err
 		}
-		return &smuxSession{client}, nil
+		return &smuxSession{Session: client}, nil
 	case ProtocolYAMux:
 		checkYAMuxConn(conn)
 		client, err := yamux.Server(conn, yaMuxConfig())
 		if err != nil {
 			return nil, err
 		}
-		return &yamuxSession{client}, nil
+		return &yamuxSession{Session: client}, nil
+	case ProtocolSingMux:
+		return newSingMuxSession(conn, false), nil
 	default:
 		return nil, E.New("unexpected protocol ", protocol)
 	}
 }
 
+const (
+	shutdownPollInterval = 100 * time.Millisecond
+	// closeFlushTimeout bounds the flush of pending writes on Close.
+	closeFlushTimeout = time.Second
+)
+
+// waitSessionsIdle waits until every session is closed or has no streams left.
+func waitSessionsIdle(ctx context.Context, sessions []abstractSession) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if common.All(sessions, func(it abstractSession) bool {
+			return it.IsClosed() || it.NumStreams() == 0
+		}) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
 func checkYAMuxConn(conn net.Conn) {
 	if conn.LocalAddr() == nil || conn.RemoteAddr() == nil {
 		panic("found net.Conn with nil addr: " + reflect.TypeOf(conn).String())
@@ -78,6 +124,9 @@ var _ abstractSession = (*smuxSession)(nil)
 
 type smuxSession struct {
 	*smux.Session
+	goAway        atomic.Bool
+	activity      *activityConn
+	probeInterval time.Duration
 }
 
 func (s *smuxSession) Open() (net.Conn, error) {
@@ -89,15 +138,108 @@ func (s *smuxSession) Accept() (net.Conn, error) {
 }
 
 func (s *smuxSession) CanTakeNewRequest() bool {
-	return true
+	return !s.goAway.Load()
+}
+
+// Ping probes client sessions with health checks only. smux has no round-trip probe, so the session
+// sends NOP keepalives at the probe interval, and Ping fails if no frame arrived within the last interval
+// and a half, to tolerate keepalives of services at the same interval. No round-trip time is measured.
+func (s *smuxSession) Ping() (time.Duration, error) {
+	if s.activity == nil {
+		return 0, os.ErrInvalid
+	}
+	idle := s.activity.idle()
+	if idle > s.probeInterval*3/2 {
+		return 0, E.New("smux: no frame received in ", idle)
+	}
+	return 0, nil
+}
+
+// Shutdown only stops opening streams locally, as smux has no GOAWAY frame like yamux and h2mux.
+// Services reject the streams opened afterwards with ErrorCodeGoingAway instead, which drains the session of the client.
+func (s *smuxSession) Shutdown() error {
+	s.goAway.Store(true)
+	return nil
+}
+
+// activityConn records the time of the last read, for the probe of smux sessions.
+type activityConn struct {
+	net.Conn
+	lastRead atomic.Int64
+}
+
+func newActivityConn(conn net.Conn) *activityConn {
+	c := &activityConn{Conn: conn}
+	c.lastRead.Store(time.Now().UnixNano())
+	return c
+}
+
+func (c *activityConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	if n > 0 {
+		c.lastRead.Store(time.Now().UnixNano())
+	}
+	return
+}
+
+func (c *activityConn) idle() time.Duration {
+	return time.Since(time.Unix(0, c.lastRead.Load()))
+}
+
+func (c *activityConn) Upstream() any {
+	return c.Conn
 }
 
 type yamuxSession struct {
 	*yamux.Session
+	goAway atomic.Bool
+}
+
+func (y *yamuxSession) Open() (net.Conn, error) {
+	stream, err := y.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &yamuxStream{stream}, nil
+}
+
+func (y *yamuxSession) Accept() (net.Conn, error) {
+	stream, err := y.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return &yamuxStream{stream}, nil
 }
 
 func (y *yamuxSession) CanTakeNewRequest() bool {
-	return true
+	return !y.goAway.Load()
+}
+
+func (y *yamuxSession) Shutdown() error {
+	y.goAway.Store(true)
+	return y.GoAway()
+}
+
+var _ N.WriteCloser = (*yamuxStream)(nil)
+
+// yamuxStream exposes the half-close of yamux, whose Close only closes the write side.
+type yamuxStream struct {
+	*yamux.Stream
+}
+
+func (s *yamuxStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+func (s *yamuxStream) Upstream() any {
+	return s.Stream
+}
+
+// canCloseWrite reports whether stream can be half-closed. smux streams and h2mux server streams,
+// as the http2 server only ends the response when the handler returns, can only be closed.
+func canCloseWrite(stream net.Conn) bool {
+	_, isCloser := common.Cast[N.WriteCloser](stream)
+	return isCloser
 }
 
 func smuxConfig() *smux.Config {
@@ -106,6 +248,30 @@ func smuxConfig() *smux.Config {
 	return config
 }
 
+func smuxClientConfig(healthCheck HealthCheckOptions) *smux.Config {
+	config := smuxConfig()
+	if healthCheck.Interval > 0 {
+		enableSmuxKeepAlive(config, healthCheck.Interval)
+	}
+	return config
+}
+
+func smuxServerConfig(keepAliveInterval time.Duration) *smux.Config {
+	config := smuxConfig()
+	if keepAliveInterval > 0 {
+		enableSmuxKeepAlive(config, keepAliveInterval)
+	}
+	return config
+}
+
+// enableSmuxKeepAlive sends NOP keepalives, but never times out the session,
+// as peers do not answer them and may not send keepalives themselves.
+func enableSmuxKeepAlive(config *smux.Config, interval time.Duration) {
+	config.KeepAliveDisabled = false
+	config.KeepAliveInterval = interval
+	config.KeepAliveTimeout = time.Duration(math.MaxInt64)
+}
+
 func yaMuxConfig() *yamux.Config {
 	config := yamux.DefaultConfig()
 	config.LogOutput = io.Discard
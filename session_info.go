@@ -0,0 +1,43 @@
+package mux
+
+import (
+	"net"
+
+	"github.com/sagernet/sing/common"
+)
+
+// SessionInfo describes the session carrying a stream.
+type SessionInfo struct {
+	// ID identifies the session among all sessions of the process.
+	ID       uint64
+	Protocol string
+	Padding  bool
+	// BrutalSendBPS is the TCP Brutal send rate negotiated for the session, or 0 if it is not enabled.
+	BrutalSendBPS uint64
+	// LocalAddr and RemoteAddr are the addresses of the connection carrying the session.
+	// On services, RemoteAddr is the source of the connection.
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+}
+
+// SessionInfoConn is implemented by the streams returned by clients, and passed to handlers by services.
+type SessionInfoConn interface {
+	SessionInfo() SessionInfo
+}
+
+var (
+	_ SessionInfoConn = (*clientConn)(nil)
+	_ SessionInfoConn = (*clientPacketConn)(nil)
+	_ SessionInfoConn = (*clientPacketAddrConn)(nil)
+	_ SessionInfoConn = (*serverConn)(nil)
+	_ SessionInfoConn = (*serverPacketConn)(nil)
+	_ SessionInfoConn = (*serverPacketAddrConn)(nil)
+)
+
+func sessionInfoOf(stream any) SessionInfo {
+	statsConn, loaded := common.Cast[*statsStream](stream)
+	if !loaded {
+		return SessionInfo{}
+	}
+	return statsConn.stats.info()
+}
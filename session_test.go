@@ -0,0 +1,41 @@
+package mux
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSmuxProbe(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	session := &smuxSession{
+		activity:      newActivityConn(clientConn),
+		probeInterval: 50 * time.Millisecond,
+	}
+	_, err := session.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, err = session.Ping()
+	if err == nil {
+		t.Fatal("expected probe failure on idle session")
+	}
+	go serverConn.Write([]byte{0})
+	_, err = session.activity.Read(make([]byte, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = session.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&smuxSession{}).Ping()
+	if !errors.Is(err, os.ErrInvalid) {
+		t.Fatal("expected unsupported ping without health checks, got ", err)
+	}
+}
@@ -0,0 +1,277 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/rw"
+)
+
+// ShapingOptions keeps a padded session shaped for its whole lifetime instead of only padding the first writes.
+// All traffic is sent in frames of the padding frame format whose total size is drawn from
+// [MinFrameSize, MaxFrameSize]: small writes are coalesced and padded, and large writes are split.
+// The client announces its options in the request, and the server shapes with the same options.
+type ShapingOptions struct {
+	MinFrameSize int
+	MaxFrameSize int
+	// CoalesceDelay is how long a write smaller than the frame size waits for more data
+	// before it is padded and sent. Zero sends it immediately.
+	CoalesceDelay time.Duration
+	// CoverInterval sends a padding-only frame when nothing was written for about this long. Zero disables it.
+	CoverInterval time.Duration
+}
+
+// Default bounds of the shaping of the writes of services.
+const (
+	DefaultMinShapingCoverInterval = time.Second
+	DefaultMaxShapingFrameSize     = 16384
+)
+
+func (o *ShapingOptions) Validate() error {
+	if o.MinFrameSize <= 4 || o.MinFrameSize > o.MaxFrameSize || o.MaxFrameSize > math.MaxUint16 {
+		return E.New("invalid shaping frame size: ", o.MinFrameSize, "-", o.MaxFrameSize)
+	}
+	if o.CoalesceDelay < 0 || o.CoalesceDelay.Milliseconds() > math.MaxUint32 {
+		return E.New("invalid shaping coalesce delay: ", o.CoalesceDelay)
+	}
+	if o.CoverInterval < 0 || o.CoverInterval.Milliseconds() > math.MaxUint32 {
+		return E.New("invalid shaping cover interval: ", o.CoverInterval)
+	}
+	return nil
+}
+
+// encoded as minFrameSize(2) + maxFrameSize(2) + coalesceDelay(4, ms) + coverInterval(4, ms)
+const shapingOptionsLen = 12
+
+func (o *ShapingOptions) writeTo(buffer *buf.Buffer) {
+	common.Must(
+		binary.Write(buffer, binary.BigEndian, uint16(o.MinFrameSize)),
+		binary.Write(buffer, binary.BigEndian, uint16(o.MaxFrameSize)),
+		binary.Write(buffer, binary.BigEndian, uint32(o.CoalesceDelay.Milliseconds())),
+		binary.Write(buffer, binary.BigEndian, uint32(o.CoverInterval.Milliseconds())),
+	)
+}
+
+func readShapingOptions(reader io.Reader) (*ShapingOptions, error) {
+	var encoded struct {
+		MinFrameSize  uint16
+		MaxFrameSize  uint16
+		CoalesceDelay uint32
+		CoverInterval uint32
+	}
+	err := binary.Read(reader, binary.BigEndian, &encoded)
+	if err != nil {
+		return nil, err
+	}
+	options := &ShapingOptions{
+		MinFrameSize:  int(encoded.MinFrameSize),
+		MaxFrameSize:  int(encoded.MaxFrameSize),
+		CoalesceDelay: time.Duration(encoded.CoalesceDelay) * time.Millisecond,
+		CoverInterval: time.Duration(encoded.CoverInterval) * time.Millisecond,
+	}
+	err = options.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+func (o *ShapingOptions) frameSize() int {
+	return o.MinFrameSize + rand.Intn(o.MaxFrameSize-o.MinFrameSize+1)
+}
+
+type shapingConn struct {
+	net.Conn
+	options          *ShapingOptions
+	onOverhead       func(n int)
+	readRemaining    int
+	paddingRemaining int
+	access           sync.Mutex
+	pending          []byte
+	frameSize        int
+	flushTimer       *time.Timer
+	lastWrite        time.Time
+	writeErr         error
+	closed           bool
+	done             chan struct{}
+}
+
+// newShapingConn reports the bytes of frame headers and padding written and read to onOverhead.
+func newShapingConn(conn net.Conn, options *ShapingOptions, onOverhead func(n int)) net.Conn {
+	c := &shapingConn{
+		Conn:       conn,
+		options:    options,
+		onOverhead: onOverhead,
+		frameSize:  options.frameSize(),
+		lastWrite:  time.Now(),
+		done:       make(chan struct{}),
+	}
+	if options.CoverInterval > 0 {
+		go c.loopCover()
+	}
+	return c
+}
+
+func (c *shapingConn) Read(p []byte) (n int, err error) {
+	for {
+		if c.readRemaining > 0 {
+			if len(p) > c.readRemaining {
+				p = p[:c.readRemaining]
+			}
+			n, err = c.Conn.Read(p)
+			c.readRemaining -= n
+			return
+		}
+		if c.paddingRemaining > 0 {
+			err = rw.SkipN(c.Conn, c.paddingRemaining)
+			if err != nil {
+				return
+			}
+			c.paddingRemaining = 0
+		}
+		var header [4]byte
+		_, err = io.ReadFull(c.Conn, header[:])
+		if err != nil {
+			return
+		}
+		c.readRemaining = int(binary.BigEndian.Uint16(header[:2]))
+		c.paddingRemaining = int(binary.BigEndian.Uint16(header[2:]))
+		c.onOverhead(4 + c.paddingRemaining)
+	}
+}
+
+func (c *shapingConn) Write(p []byte) (n int, err error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	c.pending = append(c.pending, p...)
+	for len(c.pending) >= c.frameSize-4 {
+		err = c.writeFrame(c.frameSize - 4)
+		if err != nil {
+			return
+		}
+	}
+	if len(c.pending) > 0 {
+		if c.options.CoalesceDelay == 0 {
+			err = c.writeFrame(len(c.pending))
+			if err != nil {
+				return
+			}
+		} else if c.flushTimer == nil {
+			c.flushTimer = time.AfterFunc(c.options.CoalesceDelay, c.flush)
+		}
+	}
+	return len(p), nil
+}
+
+// writeFrame must be called with access held. It sends dataLen bytes of pending data padded to the frame size.
+func (c *shapingConn) writeFrame(dataLen int) error {
+	paddingLen := c.frameSize - 4 - dataLen
+	buffer := buf.NewSize(c.frameSize)
+	defer buffer.Release()
+	header := buffer.Extend(4)
+	binary.BigEndian.PutUint16(header[:2], uint16(dataLen))
+	binary.BigEndian.PutUint16(header[2:], uint16(paddingLen))
+	common.Must1(buffer.Write(c.pending[:dataLen]))
+	buffer.Extend(paddingLen)
+	_, err := c.Conn.Write(buffer.Bytes())
+	if err != nil {
+		c.writeErr = err
+		return err
+	}
+	c.pending = c.pending[:copy(c.pending, c.pending[dataLen:])]
+	c.frameSize = c.options.frameSize()
+	c.lastWrite = time.Now()
+	c.onOverhead(4 + paddingLen)
+	return nil
+}
+
+func (c *shapingConn) flush() {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.flushTimer = nil
+	if c.writeErr != nil || c.closed || len(c.pending) == 0 {
+		return
+	}
+	if c.writeFrame(len(c.pending)) != nil {
+		c.Conn.Close()
+	}
+}
+
+func (c *shapingConn) loopCover() {
+	for {
+		// jitter the interval by ±50% so cover frames are not periodic
+		interval := c.options.CoverInterval/2 + time.Duration(rand.Int63n(int64(c.options.CoverInterval)+1))
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-c.done:
+			timer.Stop()
+			return
+		}
+		c.access.Lock()
+		if c.writeErr != nil || c.closed {
+			c.access.Unlock()
+			return
+		}
+		if time.Since(c.lastWrite) >= c.options.CoverInterval/2 && len(c.pending) == 0 {
+			if c.writeFrame(0) != nil {
+				c.access.Unlock()
+				c.Conn.Close()
+				return
+			}
+		}
+		c.access.Unlock()
+	}
+}
+
+// Close flushes pending data within closeFlushTimeout. If a write is in progress, the connection
+// is closed first, so that a stalled peer can not block it.
+func (c *shapingConn) Close() error {
+	if !c.access.TryLock() {
+		err := c.Conn.Close()
+		c.access.Lock()
+		c.closeLocked()
+		c.access.Unlock()
+		return err
+	}
+	if !c.closed {
+		c.closeLocked()
+		if c.writeErr == nil && len(c.pending) > 0 {
+			_ = c.Conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+			_ = c.writeFrame(len(c.pending))
+		}
+	}
+	c.access.Unlock()
+	return c.Conn.Close()
+}
+
+// closeLocked must be called with access held.
+func (c *shapingConn) closeLocked() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.done)
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+}
+
+func (c *shapingConn) Upstream() any {
+	return c.Conn
+}
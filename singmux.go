@@ -0,0 +1,390 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/atomic"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/rw"
+)
+
+var _ abstractSession = (*singMuxSession)(nil)
+
+type singMuxSession struct {
+	conn         net.Conn
+	client       bool
+	access       sync.Mutex
+	streams      map[uint32]*singMuxStream
+	nextStreamID uint32
+	inbound      chan *singMuxStream
+	control      chan *buf.Buffer
+	pings        map[uint64]chan struct{}
+	nextPingID   uint64
+	localGoAway  bool
+	remoteGoAway bool
+	writeAccess  sync.Mutex
+	done         chan struct{}
+	closeOnce    sync.Once
+	err          atomic.TypedValue[error]
+}
+
+func newSingMuxSession(conn net.Conn, client bool) *singMuxSession {
+	session := &singMuxSession{
+		conn:    conn,
+		client:  client,
+		streams: make(map[uint32]*singMuxStream),
+		pings:   make(map[uint64]chan struct{}),
+		inbound: make(chan *singMuxStream, singMuxAcceptBacklog),
+		control: make(chan *buf.Buffer, singMuxControlBacklog),
+		done:    make(chan struct{}),
+	}
+	if client {
+		session.nextStreamID = 1
+	} else {
+		session.nextStreamID = 2
+	}
+	go session.loopInput()
+	go session.loopControl()
+	return session
+}
+
+func (s *singMuxSession) Open() (net.Conn, error) {
+	s.access.Lock()
+	if s.IsClosed() {
+		s.access.Unlock()
+		return nil, s.closeError()
+	}
+	if s.localGoAway || s.remoteGoAway {
+		s.access.Unlock()
+		return nil, E.New("singmux: session is going away")
+	}
+	if s.nextStreamID > math.MaxUint32-2 {
+		s.access.Unlock()
+		return nil, E.New("singmux: stream id exhausted")
+	}
+	streamID := s.nextStreamID
+	s.nextStreamID += 2
+	stream := newSingMuxStream(s, streamID)
+	s.streams[streamID] = stream
+	s.access.Unlock()
+	err := s.writeFrame(newSingMuxFrame(singMuxCmdSYN, streamID, nil))
+	if err != nil {
+		s.removeStream(streamID)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *singMuxSession) Accept() (net.Conn, error) {
+	select {
+	case stream := <-s.inbound:
+		return stream, nil
+	case <-s.done:
+		return nil, s.closeError()
+	}
+}
+
+func (s *singMuxSession) NumStreams() int {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return len(s.streams)
+}
+
+func (s *singMuxSession) Close() error {
+	return s.closeWithError(os.ErrClosed)
+}
+
+func (s *singMuxSession) IsClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *singMuxSession) CanTakeNewRequest() bool {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return !s.IsClosed() && !s.localGoAway && !s.remoteGoAway && s.nextStreamID <= math.MaxUint32-2
+}
+
+func (s *singMuxSession) Shutdown() error {
+	s.access.Lock()
+	if s.localGoAway {
+		s.access.Unlock()
+		return nil
+	}
+	s.localGoAway = true
+	s.access.Unlock()
+	return s.writeFrame(newSingMuxFrame(singMuxCmdGOAWAY, 0, nil))
+}
+
+func (s *singMuxSession) Ping() (time.Duration, error) {
+	s.access.Lock()
+	pingID := s.nextPingID
+	s.nextPingID++
+	pong := make(chan struct{})
+	s.pings[pingID] = pong
+	s.access.Unlock()
+	defer func() {
+		s.access.Lock()
+		delete(s.pings, pingID)
+		s.access.Unlock()
+	}()
+	var payload [8]byte
+	binary.BigEndian.PutUint64(payload[:], pingID)
+	start := time.Now()
+	err := s.writeFrame(newSingMuxFrame(singMuxCmdPING, 0, payload[:]))
+	if err != nil {
+		return 0, err
+	}
+	timer := time.NewTimer(TCPTimeout)
+	defer timer.Stop()
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-s.done:
+		return 0, s.closeError()
+	case <-timer.C:
+		return 0, E.New("singmux: ping timeout")
+	}
+}
+
+func (s *singMuxSession) closeWithError(err error) error {
+	var closeErr error
+	s.closeOnce.Do(func() {
+		s.err.Store(err)
+		close(s.done)
+		closeErr = s.conn.Close()
+	})
+	return closeErr
+}
+
+func (s *singMuxSession) closeError() error {
+	err := s.err.Load()
+	if err == nil {
+		return os.ErrClosed
+	}
+	return err
+}
+
+func (s *singMuxSession) removeStream(streamID uint32) {
+	s.access.Lock()
+	delete(s.streams, streamID)
+	s.access.Unlock()
+}
+
+func (s *singMuxSession) writeFrame(buffer *buf.Buffer) error {
+	defer buffer.Release()
+	s.writeAccess.Lock()
+	defer s.writeAccess.Unlock()
+	if s.IsClosed() {
+		return s.closeError()
+	}
+	_, err := s.conn.Write(buffer.Bytes())
+	if err != nil {
+		s.closeWithError(err)
+	}
+	return err
+}
+
+// writeControl queues a control frame replied by the read loop, which must not wait for the connection to be writable.
+func (s *singMuxSession) writeControl(buffer *buf.Buffer) error {
+	select {
+	case s.control <- buffer:
+		return nil
+	case <-s.done:
+		buffer.Release()
+		return s.closeError()
+	}
+}
+
+func (s *singMuxSession) loopControl() {
+	for {
+		select {
+		case buffer := <-s.control:
+			err := s.writeFrame(buffer)
+			if err != nil {
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *singMuxSession) loopInput() {
+	err := s.readFrames()
+	if err != nil {
+		s.closeWithError(err)
+	}
+}
+
+func (s *singMuxSession) readFrames() error {
+	var header singMuxHeader
+	for {
+		_, err := io.ReadFull(s.conn, header[:])
+		if err != nil {
+			return err
+		}
+		streamID := header.StreamID()
+		length := header.Length()
+		switch header.Cmd() {
+		case singMuxCmdSYN:
+			if length != 0 {
+				return E.New("singmux: invalid SYN frame length: ", length)
+			}
+			err = s.acceptStream(streamID)
+		case singMuxCmdFIN:
+			if length > 1 {
+				return E.New("singmux: invalid FIN frame length: ", length)
+			}
+			var flags [1]byte
+			_, err = io.ReadFull(s.conn, flags[:length])
+			if err != nil {
+				return err
+			}
+			if stream := s.stream(streamID); stream != nil {
+				stream.remoteClose(length == 1 && flags[0]&singMuxFlagClosed != 0)
+			}
+		case singMuxCmdPSH:
+			stream := s.stream(streamID)
+			if stream == nil {
+				err = rw.SkipN(s.conn, length)
+				if err != nil {
+					return err
+				}
+				err = s.creditSkipped(streamID, length)
+				break
+			}
+			buffer := stream.newReadBuffer(length)
+			_, err = buffer.ReadFullFrom(s.conn, length)
+			if err != nil {
+				buffer.Release()
+				return err
+			}
+			var pushed bool
+			pushed, err = stream.pushBuffer(buffer)
+			if err == nil && !pushed {
+				err = s.creditSkipped(streamID, length)
+			}
+		case singMuxCmdUPD:
+			if length != 4 {
+				return E.New("singmux: invalid UPD frame length: ", length)
+			}
+			var increment uint32
+			err = binary.Read(s.conn, binary.BigEndian, &increment)
+			if err != nil {
+				return err
+			}
+			if stream := s.stream(streamID); stream != nil {
+				stream.updateSendWindow(increment)
+			}
+		case singMuxCmdPING, singMuxCmdPONG:
+			if length != 8 {
+				return E.New("singmux: invalid ping frame length: ", length)
+			}
+			var payload [8]byte
+			_, err = io.ReadFull(s.conn, payload[:])
+			if err != nil {
+				return err
+			}
+			if header.Cmd() == singMuxCmdPING {
+				err = s.writeControl(newSingMuxFrame(singMuxCmdPONG, 0, payload[:]))
+			} else {
+				s.handlePong(binary.BigEndian.Uint64(payload[:]))
+			}
+		case singMuxCmdRST:
+			if length != 1 {
+				return E.New("singmux: invalid RST frame length: ", length)
+			}
+			var code [1]byte
+			_, err = io.ReadFull(s.conn, code[:])
+			if err != nil {
+				return err
+			}
+			if stream := s.stream(streamID); stream != nil {
+				stream.remoteReset(ErrorCode(code[0]))
+			}
+		case singMuxCmdGOAWAY:
+			if length != 0 {
+				return E.New("singmux: invalid GOAWAY frame length: ", length)
+			}
+			s.access.Lock()
+			s.remoteGoAway = true
+			s.access.Unlock()
+		default:
+			return E.New("singmux: unknown command: ", header.Cmd())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// creditSkipped returns the window of data dropped for closed streams, so that the sender never waits for it.
+func (s *singMuxSession) creditSkipped(streamID uint32, length int) error {
+	if length == 0 {
+		return nil
+	}
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], uint32(length))
+	return s.writeControl(newSingMuxFrame(singMuxCmdUPD, streamID, payload[:]))
+}
+
+func (s *singMuxSession) stream(streamID uint32) *singMuxStream {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.streams[streamID]
+}
+
+func (s *singMuxSession) handlePong(pingID uint64) {
+	s.access.Lock()
+	pong, loaded := s.pings[pingID]
+	if loaded {
+		delete(s.pings, pingID)
+	}
+	s.access.Unlock()
+	if loaded {
+		close(pong)
+	}
+}
+
+func (s *singMuxSession) acceptStream(streamID uint32) error {
+	if (streamID%2 == 1) == s.client {
+		return E.New("singmux: unexpected stream id from peer: ", streamID)
+	}
+	s.access.Lock()
+	if _, loaded := s.streams[streamID]; loaded {
+		s.access.Unlock()
+		return E.New("singmux: duplicate stream id: ", streamID)
+	}
+	if s.localGoAway {
+		s.access.Unlock()
+		// refuse streams that crossed our GOAWAY, so that the client opens them on another session
+		return s.refuseStream(streamID, ErrorCodeGoingAway)
+	}
+	stream := newSingMuxStream(s, streamID)
+	s.streams[streamID] = stream
+	s.access.Unlock()
+	select {
+	case s.inbound <- stream:
+		return nil
+	default:
+		// refuse streams over the accept backlog instead of blocking the read loop of other streams
+		s.removeStream(streamID)
+		return s.refuseStream(streamID, ErrorCodeRejected)
+	}
+}
+
+func (s *singMuxSession) refuseStream(streamID uint32, code ErrorCode) error {
+	return s.writeControl(newSingMuxFrame(singMuxCmdRST, streamID, []byte{byte(code)}))
+}
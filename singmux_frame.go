@@ -0,0 +1,60 @@
+package mux
+
+import (
+	"encoding/binary"
+
+	"github.com/sagernet/sing/common/buf"
+)
+
+const (
+	singMuxCmdSYN byte = iota
+	singMuxCmdFIN
+	singMuxCmdPSH
+	singMuxCmdUPD
+	singMuxCmdPING
+	singMuxCmdPONG
+	singMuxCmdGOAWAY
+	// singMuxCmdRST aborts a stream, carrying the ErrorCode given to Reset as a single byte.
+	singMuxCmdRST
+)
+
+// singMuxFlagClosed is the optional flag byte of FIN sent by Close, which tells that the sender no longer reads the stream.
+const singMuxFlagClosed byte = 1
+
+const (
+	// frame header: cmd(1) + length(2) + streamID(4)
+	singMuxHeaderLen     = 7
+	singMuxMaxFrameSize  = 65535
+	singMuxInitialWindow = 256 * 1024
+	// streams over the accept backlog are refused with ErrorCodeRejected
+	singMuxAcceptBacklog = 1024
+	// control frames are replied by the read loop through a bounded queue, which stops reading when it is full
+	singMuxControlBacklog = 64
+)
+
+type singMuxHeader [singMuxHeaderLen]byte
+
+func (h singMuxHeader) Cmd() byte {
+	return h[0]
+}
+
+func (h singMuxHeader) Length() int {
+	return int(binary.BigEndian.Uint16(h[1:3]))
+}
+
+func (h singMuxHeader) StreamID() uint32 {
+	return binary.BigEndian.Uint32(h[3:])
+}
+
+func putSingMuxHeader(header []byte, cmd byte, length int, streamID uint32) {
+	header[0] = cmd
+	binary.BigEndian.PutUint16(header[1:3], uint16(length))
+	binary.BigEndian.PutUint32(header[3:], streamID)
+}
+
+func newSingMuxFrame(cmd byte, streamID uint32, payload []byte) *buf.Buffer {
+	buffer := buf.NewSize(singMuxHeaderLen + len(payload))
+	putSingMuxHeader(buffer.Extend(singMuxHeaderLen), cmd, len(payload), streamID)
+	buffer.Write(payload)
+	return buffer
+}
@@ -0,0 +1,404 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/pipe"
+)
+
+var (
+	_ N.ExtendedConn = (*singMuxStream)(nil)
+	_ N.ReadWaiter   = (*singMuxStream)(nil)
+	_ N.WriteCloser  = (*singMuxStream)(nil)
+	_ streamResetter = (*singMuxStream)(nil)
+)
+
+type singMuxStream struct {
+	session         *singMuxSession
+	id              uint32
+	access          sync.Mutex
+	buffers         []*buf.Buffer
+	readWaitOptions N.ReadWaitOptions
+	recvPending     int
+	recvConsumed    int
+	sendWindow      int
+	remoteClosed    bool
+	peerClosed      bool
+	resetErr        error
+	writeClosed     bool
+	closed          bool
+	done            chan struct{}
+	readNotify      chan struct{}
+	sendNotify      chan struct{}
+	writeAccess     sync.Mutex
+	readDeadline    pipe.Deadline
+	writeDeadline   pipe.Deadline
+}
+
+func newSingMuxStream(session *singMuxSession, streamID uint32) *singMuxStream {
+	return &singMuxStream{
+		session:       session,
+		id:            streamID,
+		sendWindow:    singMuxInitialWindow,
+		done:          make(chan struct{}),
+		readNotify:    make(chan struct{}, 1),
+		sendNotify:    make(chan struct{}, 1),
+		readDeadline:  pipe.MakeDeadline(),
+		writeDeadline: pipe.MakeDeadline(),
+	}
+}
+
+func newSingMuxReadBuffer(options N.ReadWaitOptions, length int) *buf.Buffer {
+	buffer := buf.NewSize(options.FrontHeadroom + length + options.RearHeadroom)
+	buffer.Resize(options.FrontHeadroom, 0)
+	buffer.Reserve(options.RearHeadroom)
+	return buffer
+}
+
+func (s *singMuxStream) newReadBuffer(length int) *buf.Buffer {
+	s.access.Lock()
+	options := s.readWaitOptions
+	s.access.Unlock()
+	return newSingMuxReadBuffer(options, length)
+}
+
+// pushBuffer reports whether the buffer is queued, as data for closed or reset streams is dropped.
+func (s *singMuxStream) pushBuffer(buffer *buf.Buffer) (bool, error) {
+	s.access.Lock()
+	if s.closed || s.resetErr != nil || buffer.IsEmpty() {
+		s.access.Unlock()
+		buffer.Release()
+		return false, nil
+	}
+	s.recvPending += buffer.Len()
+	if s.recvPending > singMuxInitialWindow {
+		s.access.Unlock()
+		buffer.Release()
+		return false, E.New("singmux: stream ", s.id, " exceeded receive window")
+	}
+	s.buffers = append(s.buffers, buffer)
+	s.access.Unlock()
+	notify(s.readNotify)
+	return true, nil
+}
+
+// remoteClose ends reads after buffered data. Writes only fail if the peer has closed the stream, as FIN of
+// CloseWrite leaves the stream writable.
+func (s *singMuxStream) remoteClose(peerClosed bool) {
+	s.access.Lock()
+	s.remoteClosed = true
+	if peerClosed {
+		s.peerClosed = true
+	}
+	s.access.Unlock()
+	notify(s.readNotify)
+	notify(s.sendNotify)
+}
+
+// remoteReset discards unread data, and fails reads and writes with a StreamResetError.
+func (s *singMuxStream) remoteReset(code ErrorCode) {
+	s.access.Lock()
+	s.resetErr = &StreamResetError{Code: code}
+	buf.ReleaseMulti(s.buffers)
+	s.buffers = nil
+	s.access.Unlock()
+	notify(s.readNotify)
+	notify(s.sendNotify)
+}
+
+func (s *singMuxStream) updateSendWindow(increment uint32) {
+	s.access.Lock()
+	s.sendWindow += int(increment)
+	s.access.Unlock()
+	notify(s.sendNotify)
+}
+
+// consume must be called with access held, and returns the window update to send, if any.
+func (s *singMuxStream) consume(n int) (increment int) {
+	s.recvConsumed += n
+	if s.recvConsumed >= singMuxInitialWindow/2 {
+		increment = s.recvConsumed
+		s.recvConsumed = 0
+		s.recvPending -= increment
+	}
+	return
+}
+
+func (s *singMuxStream) sendWindowUpdate(increment int) {
+	if increment == 0 {
+		return
+	}
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], uint32(increment))
+	_ = s.session.writeFrame(newSingMuxFrame(singMuxCmdUPD, s.id, payload[:]))
+}
+
+// readError must be called with access held.
+func (s *singMuxStream) readError() error {
+	if s.closed {
+		return io.ErrClosedPipe
+	}
+	if s.resetErr != nil {
+		return s.resetErr
+	}
+	if s.remoteClosed {
+		return io.EOF
+	}
+	if s.session.IsClosed() {
+		return s.session.closeError()
+	}
+	return nil
+}
+
+func (s *singMuxStream) waitRead() error {
+	select {
+	case <-s.readNotify:
+		return nil
+	case <-s.done:
+		return nil
+	case <-s.session.done:
+		return nil
+	case <-s.readDeadline.Wait():
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (s *singMuxStream) Read(p []byte) (n int, err error) {
+	for {
+		s.access.Lock()
+		if len(s.buffers) > 0 {
+			buffer := s.buffers[0]
+			n, _ = buffer.Read(p)
+			if buffer.IsEmpty() {
+				buffer.Release()
+				s.buffers[0] = nil
+				s.buffers = s.buffers[1:]
+			}
+			increment := s.consume(n)
+			s.access.Unlock()
+			s.sendWindowUpdate(increment)
+			return
+		}
+		err = s.readError()
+		s.access.Unlock()
+		if err != nil {
+			return
+		}
+		err = s.waitRead()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *singMuxStream) ReadBuffer(buffer *buf.Buffer) error {
+	n, err := s.Read(buffer.FreeBytes())
+	buffer.Truncate(n)
+	return err
+}
+
+func (s *singMuxStream) InitializeReadWaiter(options N.ReadWaitOptions) (needCopy bool) {
+	s.access.Lock()
+	s.readWaitOptions = options
+	s.access.Unlock()
+	return false
+}
+
+func (s *singMuxStream) WaitReadBuffer() (buffer *buf.Buffer, err error) {
+	for {
+		s.access.Lock()
+		if len(s.buffers) > 0 {
+			buffer = s.buffers[0]
+			s.buffers[0] = nil
+			s.buffers = s.buffers[1:]
+			options := s.readWaitOptions
+			increment := s.consume(buffer.Len())
+			s.access.Unlock()
+			s.sendWindowUpdate(increment)
+			if buffer.Start() < options.FrontHeadroom || buffer.RawCap()-buffer.Cap() < options.RearHeadroom {
+				newBuffer := newSingMuxReadBuffer(options, buffer.Len())
+				common.Must1(newBuffer.Write(buffer.Bytes()))
+				buffer.Release()
+				buffer = newBuffer
+			}
+			options.PostReturn(buffer)
+			return
+		}
+		err = s.readError()
+		s.access.Unlock()
+		if err != nil {
+			return
+		}
+		err = s.waitRead()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *singMuxStream) acquireSendWindow(size int) error {
+	for {
+		s.access.Lock()
+		if s.closed || s.writeClosed {
+			s.access.Unlock()
+			return io.ErrClosedPipe
+		}
+		if s.resetErr != nil {
+			err := s.resetErr
+			s.access.Unlock()
+			return err
+		}
+		if s.peerClosed {
+			s.access.Unlock()
+			return io.ErrClosedPipe
+		}
+		if s.session.IsClosed() {
+			s.access.Unlock()
+			return s.session.closeError()
+		}
+		if s.sendWindow >= size {
+			s.sendWindow -= size
+			s.access.Unlock()
+			return nil
+		}
+		s.access.Unlock()
+		select {
+		case <-s.sendNotify:
+		case <-s.done:
+		case <-s.session.done:
+		case <-s.writeDeadline.Wait():
+			return os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (s *singMuxStream) Write(p []byte) (n int, err error) {
+	s.writeAccess.Lock()
+	defer s.writeAccess.Unlock()
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > singMuxMaxFrameSize {
+			chunk = chunk[:singMuxMaxFrameSize]
+		}
+		err = s.acquireSendWindow(len(chunk))
+		if err != nil {
+			return
+		}
+		err = s.session.writeFrame(newSingMuxFrame(singMuxCmdPSH, s.id, chunk))
+		if err != nil {
+			return
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return
+}
+
+func (s *singMuxStream) WriteBuffer(buffer *buf.Buffer) error {
+	bufferLen := buffer.Len()
+	if bufferLen == 0 {
+		buffer.Release()
+		return nil
+	}
+	if bufferLen > singMuxMaxFrameSize || buffer.Start() < singMuxHeaderLen {
+		defer buffer.Release()
+		return common.Error(s.Write(buffer.Bytes()))
+	}
+	s.writeAccess.Lock()
+	defer s.writeAccess.Unlock()
+	err := s.acquireSendWindow(bufferLen)
+	if err != nil {
+		buffer.Release()
+		return err
+	}
+	putSingMuxHeader(buffer.ExtendHeader(singMuxHeaderLen), singMuxCmdPSH, bufferLen, s.id)
+	return s.session.writeFrame(buffer)
+}
+
+func (s *singMuxStream) FrontHeadroom() int {
+	return singMuxHeaderLen
+}
+
+// CloseWrite sends FIN after pending writes, leaving the stream readable, as FIN only ends the data of the sender.
+func (s *singMuxStream) CloseWrite() error {
+	s.writeAccess.Lock()
+	defer s.writeAccess.Unlock()
+	s.access.Lock()
+	if s.closed || s.writeClosed {
+		s.access.Unlock()
+		return nil
+	}
+	s.writeClosed = true
+	s.access.Unlock()
+	if s.session.IsClosed() {
+		return nil
+	}
+	return s.session.writeFrame(newSingMuxFrame(singMuxCmdFIN, s.id, nil))
+}
+
+// Close sends FIN with singMuxFlagClosed, which fails pending and later writes of the peer.
+func (s *singMuxStream) Close() error {
+	return s.close(singMuxCmdFIN, []byte{singMuxFlagClosed})
+}
+
+func (s *singMuxStream) reset(code ErrorCode) error {
+	return s.close(singMuxCmdRST, []byte{byte(code)})
+}
+
+func (s *singMuxStream) close(cmd byte, payload []byte) error {
+	s.access.Lock()
+	if s.closed {
+		s.access.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	buf.ReleaseMulti(s.buffers)
+	s.buffers = nil
+	s.access.Unlock()
+	s.session.removeStream(s.id)
+	if s.session.IsClosed() {
+		return nil
+	}
+	return s.session.writeFrame(newSingMuxFrame(cmd, s.id, payload))
+}
+
+func (s *singMuxStream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+func (s *singMuxStream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
+
+func (s *singMuxStream) SetDeadline(t time.Time) error {
+	s.readDeadline.Set(t)
+	s.writeDeadline.Set(t)
+	return nil
+}
+
+func (s *singMuxStream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.Set(t)
+	return nil
+}
+
+func (s *singMuxStream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.Set(t)
+	return nil
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,245 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func newSingMuxPair(t *testing.T) (client *singMuxSession, server *singMuxSession) {
+	clientConn, serverConn := net.Pipe()
+	client = newSingMuxSession(clientConn, true)
+	server = newSingMuxSession(serverConn, false)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return
+}
+
+func openSingMuxStream(t *testing.T, client *singMuxSession, server *singMuxSession) (clientStream net.Conn, serverStream net.Conn) {
+	clientStream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverStream, err = server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestSingMuxStream(t *testing.T) {
+	client, server := newSingMuxPair(t)
+	clientStream, serverStream := openSingMuxStream(t, client, server)
+	if server.NumStreams() != 1 || client.NumStreams() != 1 {
+		t.Fatal("unexpected stream count")
+	}
+	payload := bytes.Repeat([]byte("singmux"), 20000)
+	go clientStream.Write(payload)
+	received := make([]byte, len(payload))
+	_, err := io.ReadFull(serverStream, received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, payload) {
+		t.Fatal("payload mismatch")
+	}
+	_, err = serverStream.Write([]byte("pong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response [4]byte
+	_, err = io.ReadFull(clientStream, response[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response[:]) != "pong" {
+		t.Fatal("unexpected response: ", string(response[:]))
+	}
+}
+
+func TestSingMuxCloseWrite(t *testing.T) {
+	client, server := newSingMuxPair(t)
+	clientStream, serverStream := openSingMuxStream(t, client, server)
+	_, err := clientStream.Write([]byte("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = clientStream.(*singMuxStream).CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := io.ReadAll(serverStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(request) != "request" {
+		t.Fatal("unexpected request: ", string(request))
+	}
+	_, err = serverStream.Write([]byte("response"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = serverStream.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := io.ReadAll(clientStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "response" {
+		t.Fatal("unexpected response: ", string(response))
+	}
+	_, err = clientStream.Write([]byte("request"))
+	if err == nil {
+		t.Fatal("write after CloseWrite succeeded")
+	}
+}
+
+func TestSingMuxReset(t *testing.T) {
+	client, server := newSingMuxPair(t)
+	clientStream, serverStream := openSingMuxStream(t, client, server)
+	err := clientStream.(*singMuxStream).reset(ErrorCodeConnectionReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = serverStream.Read(make([]byte, 1))
+	var resetErr *StreamResetError
+	if !errors.As(err, &resetErr) || resetErr.Code != ErrorCodeConnectionReset {
+		t.Fatal("unexpected read error: ", err)
+	}
+	_, err = serverStream.Write([]byte("data"))
+	if !errors.As(err, &resetErr) {
+		t.Fatal("unexpected write error: ", err)
+	}
+	_, err = clientStream.Read(make([]byte, 1))
+	if !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatal("unexpected read error: ", err)
+	}
+}
+
+func TestSingMuxWindowExhausted(t *testing.T) {
+	client, server := newSingMuxPair(t)
+	clientStream, serverStream := openSingMuxStream(t, client, server)
+	err := clientStream.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := clientStream.Write(make([]byte, singMuxInitialWindow+1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("unexpected write error: ", err)
+	}
+	if n == 0 || n > singMuxInitialWindow {
+		t.Fatal("unexpected written length: ", n)
+	}
+	err = clientStream.SetWriteDeadline(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeDone := make(chan error, 1)
+	go func() {
+		_, writeErr := clientStream.Write(make([]byte, singMuxMaxFrameSize))
+		writeDone <- writeErr
+	}()
+	time.Sleep(50 * time.Millisecond)
+	err = serverStream.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-writeDone:
+		if !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatal("unexpected write error: ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked after the peer closed the stream")
+	}
+}
+
+func TestSingMuxControlFrames(t *testing.T) {
+	rawConn, serverConn := net.Pipe()
+	server := newSingMuxSession(serverConn, false)
+	defer server.Close()
+	defer rawConn.Close()
+	writeRawFrame(t, rawConn, singMuxCmdSYN, 1, nil)
+	serverStream, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serverStream.Close()
+	cmd, streamID, payload := readRawFrame(t, rawConn)
+	if cmd != singMuxCmdFIN || streamID != 1 || !bytes.Equal(payload, []byte{singMuxFlagClosed}) {
+		t.Fatal("unexpected frame: ", cmd, " ", streamID, " ", payload)
+	}
+	writeRawFrame(t, rawConn, singMuxCmdPSH, 1, make([]byte, 100))
+	cmd, streamID, payload = readRawFrame(t, rawConn)
+	if cmd != singMuxCmdUPD || streamID != 1 || binary.BigEndian.Uint32(payload) != 100 {
+		t.Fatal("skipped data not credited: ", cmd, " ", streamID, " ", payload)
+	}
+	writeRawFrame(t, rawConn, singMuxCmdPING, 0, []byte{0, 0, 0, 0, 0, 0, 0, 42})
+	cmd, _, payload = readRawFrame(t, rawConn)
+	if cmd != singMuxCmdPONG || binary.BigEndian.Uint64(payload) != 42 {
+		t.Fatal("unexpected ping reply: ", cmd, " ", payload)
+	}
+}
+
+func TestSingMuxRefuseStreams(t *testing.T) {
+	rawConn, serverConn := net.Pipe()
+	server := newSingMuxSession(serverConn, false)
+	defer server.Close()
+	defer rawConn.Close()
+	streamID := uint32(1)
+	for ; streamID < 2*singMuxAcceptBacklog; streamID += 2 {
+		writeRawFrame(t, rawConn, singMuxCmdSYN, streamID, nil)
+	}
+	writeRawFrame(t, rawConn, singMuxCmdSYN, streamID, nil)
+	cmd, refusedID, payload := readRawFrame(t, rawConn)
+	if cmd != singMuxCmdRST || refusedID != streamID || !bytes.Equal(payload, []byte{byte(ErrorCodeRejected)}) {
+		t.Fatal("stream over the accept backlog not rejected: ", cmd, " ", refusedID, " ", payload)
+	}
+	if server.NumStreams() != singMuxAcceptBacklog {
+		t.Fatal("unexpected stream count: ", server.NumStreams())
+	}
+	go server.Shutdown()
+	cmd, _, _ = readRawFrame(t, rawConn)
+	if cmd != singMuxCmdGOAWAY {
+		t.Fatal("unexpected frame: ", cmd)
+	}
+	streamID += 2
+	writeRawFrame(t, rawConn, singMuxCmdSYN, streamID, nil)
+	cmd, refusedID, payload = readRawFrame(t, rawConn)
+	if cmd != singMuxCmdRST || refusedID != streamID || !bytes.Equal(payload, []byte{byte(ErrorCodeGoingAway)}) {
+		t.Fatal("stream after GOAWAY not refused as going away: ", cmd, " ", refusedID, " ", payload)
+	}
+}
+
+func writeRawFrame(t *testing.T, conn net.Conn, cmd byte, streamID uint32, payload []byte) {
+	frame := newSingMuxFrame(cmd, streamID, payload)
+	defer frame.Release()
+	_, err := conn.Write(frame.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readRawFrame(t *testing.T, conn net.Conn) (cmd byte, streamID uint32, payload []byte) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var header singMuxHeader
+	_, err := io.ReadFull(conn, header[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload = make([]byte, header.Length())
+	_, err = io.ReadFull(conn, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header.Cmd(), header.StreamID(), payload
+}
@@ -0,0 +1,265 @@
+package mux
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/atomic"
+)
+
+// Stats is a snapshot of the sessions held by a Client or Service.
+type Stats struct {
+	Sessions []SessionStats
+	// StreamsOpened, StreamsClosed, Upload, Download and PaddingOverhead are totals
+	// since the Client or Service was created, including closed sessions.
+	StreamsOpened   uint64
+	StreamsClosed   uint64
+	Upload          uint64
+	Download        uint64
+	PaddingOverhead uint64
+	// HandshakeFailures counts failed session and stream handshakes by HandshakeFailure* reason.
+	HandshakeFailures map[string]uint64
+	// StreamOpenLatency is the time taken by the client to open streams, including dialing new sessions.
+	StreamOpenLatency LatencyHistogram
+}
+
+// SessionStats is a snapshot of a single session.
+// Upload and Download count stream payload written and read by the local side.
+type SessionStats struct {
+	// ID matches SessionInfo.ID of the streams of the session.
+	ID              uint64
+	Protocol        string
+	Padding         bool
+	CreatedAt       time.Time
+	Age             time.Duration
+	ActiveStreams   int
+	StreamsOpened   uint64
+	StreamsClosed   uint64
+	Upload          uint64
+	Download        uint64
+	PaddingOverhead uint64
+	// BrutalSendBPS is the TCP Brutal send rate negotiated for the session, or 0 if it is not enabled.
+	BrutalSendBPS uint64
+}
+
+// Handshake failure reasons counted in Stats.HandshakeFailures.
+const (
+	HandshakeFailureDial          = "dial"
+	HandshakeFailureSession       = "session"
+	HandshakeFailureBrutal        = "brutal"
+	HandshakeFailureRequest       = "request"
+	HandshakeFailurePadding       = "padding"
+	HandshakeFailureStreamRequest = "stream_request"
+	HandshakeFailureShutdown      = "shutdown"
+	HandshakeFailureLimit         = "limit"
+	HandshakeFailureAuth          = "auth"
+)
+
+// LatencyBuckets are the upper bounds of the LatencyHistogram buckets.
+var LatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// LatencyHistogram counts samples per bucket: Counts[i] holds the samples greater than LatencyBuckets[i-1]
+// and no greater than LatencyBuckets[i], and the last element holds the samples greater than all buckets.
+type LatencyHistogram struct {
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+type statsCounters struct {
+	streamsOpened     atomic.Uint64
+	streamsClosed     atomic.Uint64
+	upload            atomic.Uint64
+	download          atomic.Uint64
+	paddingOverhead   atomic.Uint64
+	access            sync.Mutex
+	handshakeFailures map[string]uint64
+	openLatency       LatencyHistogram
+}
+
+func (c *statsCounters) addHandshakeFailure(reason string) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.handshakeFailures == nil {
+		c.handshakeFailures = make(map[string]uint64)
+	}
+	c.handshakeFailures[reason]++
+}
+
+func (c *statsCounters) addStreamOpenLatency(latency time.Duration) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.openLatency.Counts == nil {
+		c.openLatency.Counts = make([]uint64, len(LatencyBuckets)+1)
+	}
+	index := len(LatencyBuckets)
+	for i, bucket := range LatencyBuckets {
+		if latency <= bucket {
+			index = i
+			break
+		}
+	}
+	c.openLatency.Counts[index]++
+	c.openLatency.Count++
+	c.openLatency.Sum += latency
+}
+
+func (c *statsCounters) snapshot() Stats {
+	stats := Stats{
+		StreamsOpened:     c.streamsOpened.Load(),
+		StreamsClosed:     c.streamsClosed.Load(),
+		Upload:            c.upload.Load(),
+		Download:          c.download.Load(),
+		PaddingOverhead:   c.paddingOverhead.Load(),
+		HandshakeFailures: make(map[string]uint64),
+		StreamOpenLatency: LatencyHistogram{
+			Counts: make([]uint64, len(LatencyBuckets)+1),
+		},
+	}
+	c.access.Lock()
+	defer c.access.Unlock()
+	for reason, count := range c.handshakeFailures {
+		stats.HandshakeFailures[reason] = count
+	}
+	copy(stats.StreamOpenLatency.Counts, c.openLatency.Counts)
+	stats.StreamOpenLatency.Count = c.openLatency.Count
+	stats.StreamOpenLatency.Sum = c.openLatency.Sum
+	return stats
+}
+
+// sessionIDCounter numbers the sessions of all clients and services.
+var sessionIDCounter atomic.Uint64
+
+type sessionStats struct {
+	parent          *statsCounters
+	id              uint64
+	protocol        byte
+	padding         bool
+	localAddr       net.Addr
+	remoteAddr      net.Addr
+	createdAt       time.Time
+	streamsOpened   atomic.Uint64
+	streamsClosed   atomic.Uint64
+	upload          atomic.Uint64
+	download        atomic.Uint64
+	paddingOverhead atomic.Uint64
+	brutalSendBPS   atomic.Uint64
+}
+
+func newSessionStats(parent *statsCounters, protocol byte, padding bool, localAddr net.Addr, remoteAddr net.Addr) *sessionStats {
+	return &sessionStats{
+		parent:     parent,
+		id:         sessionIDCounter.Add(1),
+		protocol:   protocol,
+		padding:    padding,
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+		createdAt:  time.Now(),
+	}
+}
+
+func (s *sessionStats) addStreamOpened() {
+	s.streamsOpened.Add(1)
+	s.parent.streamsOpened.Add(1)
+}
+
+func (s *sessionStats) addStreamClosed() {
+	s.streamsClosed.Add(1)
+	s.parent.streamsClosed.Add(1)
+}
+
+func (s *sessionStats) addUpload(n int) {
+	s.upload.Add(uint64(n))
+	s.parent.upload.Add(uint64(n))
+}
+
+func (s *sessionStats) addDownload(n int) {
+	s.download.Add(uint64(n))
+	s.parent.download.Add(uint64(n))
+}
+
+func (s *sessionStats) addPaddingOverhead(n int) {
+	s.paddingOverhead.Add(uint64(n))
+	s.parent.paddingOverhead.Add(uint64(n))
+}
+
+func (s *sessionStats) info() SessionInfo {
+	return SessionInfo{
+		ID:            s.id,
+		Protocol:      protocolName(s.protocol),
+		Padding:       s.padding,
+		BrutalSendBPS: s.brutalSendBPS.Load(),
+		LocalAddr:     s.localAddr,
+		RemoteAddr:    s.remoteAddr,
+	}
+}
+
+func (s *sessionStats) snapshot(session abstractSession) SessionStats {
+	return SessionStats{
+		ID:              s.id,
+		Protocol:        protocolName(s.protocol),
+		Padding:         s.padding,
+		CreatedAt:       s.createdAt,
+		Age:             time.Since(s.createdAt),
+		ActiveStreams:   session.NumStreams(),
+		StreamsOpened:   s.streamsOpened.Load(),
+		StreamsClosed:   s.streamsClosed.Load(),
+		Upload:          s.upload.Load(),
+		Download:        s.download.Load(),
+		PaddingOverhead: s.paddingOverhead.Load(),
+		BrutalSendBPS:   s.brutalSendBPS.Load(),
+	}
+}
+
+type statsStream struct {
+	net.Conn
+	stats  *sessionStats
+	closed atomic.Bool
+}
+
+func newStatsStream(conn net.Conn, stats *sessionStats) *statsStream {
+	stats.addStreamOpened()
+	return &statsStream{Conn: conn, stats: stats}
+}
+
+func (s *statsStream) Read(p []byte) (n int, err error) {
+	n, err = s.Conn.Read(p)
+	s.stats.addDownload(n)
+	return
+}
+
+func (s *statsStream) Write(p []byte) (n int, err error) {
+	n, err = s.Conn.Write(p)
+	s.stats.addUpload(n)
+	return
+}
+
+// LocalAddr and RemoteAddr report the addresses of the session, as not all protocols expose them on streams.
+func (s *statsStream) LocalAddr() net.Addr {
+	return s.stats.localAddr
+}
+
+func (s *statsStream) RemoteAddr() net.Addr {
+	return s.stats.remoteAddr
+}
+
+func (s *statsStream) Close() error {
+	if !s.closed.Swap(true) {
+		s.stats.addStreamClosed()
+	}
+	return s.Conn.Close()
+}
+
+func (s *statsStream) Upstream() any {
+	return s.Conn
+}
@@ -0,0 +1,54 @@
+package mux
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+// StreamResetter is implemented by the streams of clients and services.
+type StreamResetter interface {
+	// Reset aborts and closes the stream, discarding data not yet read by the peer.
+	// Reads of the peer fail with a StreamResetError, which carries code on singmux and from h2mux clients.
+	// h2mux services can not send codes, so their clients get ErrorCodeGeneral.
+	// smux and yamux can not abort streams, so they are closed instead.
+	Reset(code ErrorCode) error
+}
+
+var (
+	_ StreamResetter = (*clientConn)(nil)
+	_ StreamResetter = (*clientPacketConn)(nil)
+	_ StreamResetter = (*clientPacketAddrConn)(nil)
+	_ StreamResetter = (*serverConn)(nil)
+	_ StreamResetter = (*serverPacketConn)(nil)
+	_ StreamResetter = (*serverPacketAddrConn)(nil)
+)
+
+// StreamResetError is returned by streams reset by the peer, instead of io.EOF.
+// It unwraps to syscall.ECONNRESET, so that relays can reset their side of the connection in turn.
+type StreamResetError struct {
+	Code ErrorCode
+}
+
+func (e *StreamResetError) Error() string {
+	return "stream reset by peer: " + e.Code.String()
+}
+
+func (e *StreamResetError) Unwrap() error {
+	return syscall.ECONNRESET
+}
+
+// streamResetter is implemented by the streams of protocols that can abort streams.
+type streamResetter interface {
+	reset(code ErrorCode) error
+}
+
+// resetStream aborts stream where the protocol allows it, and closes it either way.
+func resetStream(stream net.Conn, code ErrorCode) error {
+	if resetter, isResetter := common.Cast[streamResetter](stream); isResetter {
+		return E.Errors(resetter.reset(code), stream.Close())
+	}
+	return stream.Close()
+}
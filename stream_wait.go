@@ -0,0 +1,74 @@
+package mux
+
+import (
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// The stream wrappers only create read waiters when the stream of the protocol has one,
+// so that reads are passed through without a copy.
+
+var (
+	_ N.ReadWaitCreator = (*wrapStream)(nil)
+	_ N.ReadWaitCreator = (*clientStream)(nil)
+	_ N.ReadWaitCreator = (*statsStream)(nil)
+)
+
+func (w *wrapStream) CreateReadWaiter() (N.ReadWaiter, bool) {
+	readWaiter, isReadWaiter := bufio.CreateReadWaiter(w.Conn)
+	if !isReadWaiter {
+		return nil, false
+	}
+	return &wrapReadWaiter{readWaiter}, true
+}
+
+type wrapReadWaiter struct {
+	N.ReadWaiter
+}
+
+func (w *wrapReadWaiter) WaitReadBuffer() (buffer *buf.Buffer, err error) {
+	buffer, err = w.ReadWaiter.WaitReadBuffer()
+	err = wrapError(err)
+	return
+}
+
+func (c *clientStream) CreateReadWaiter() (N.ReadWaiter, bool) {
+	readWaiter, isReadWaiter := bufio.CreateReadWaiter(c.Conn)
+	if !isReadWaiter {
+		return nil, false
+	}
+	return &clientStreamReadWaiter{readWaiter, c.session}, true
+}
+
+type clientStreamReadWaiter struct {
+	N.ReadWaiter
+	session *clientSession
+}
+
+func (w *clientStreamReadWaiter) WaitReadBuffer() (buffer *buf.Buffer, err error) {
+	buffer, err = w.ReadWaiter.WaitReadBuffer()
+	w.session.onBytesTransferred()
+	return
+}
+
+func (s *statsStream) CreateReadWaiter() (N.ReadWaiter, bool) {
+	readWaiter, isReadWaiter := bufio.CreateReadWaiter(s.Conn)
+	if !isReadWaiter {
+		return nil, false
+	}
+	return &statsReadWaiter{readWaiter, s.stats}, true
+}
+
+type statsReadWaiter struct {
+	N.ReadWaiter
+	stats *sessionStats
+}
+
+func (w *statsReadWaiter) WaitReadBuffer() (buffer *buf.Buffer, err error) {
+	buffer, err = w.ReadWaiter.WaitReadBuffer()
+	if err == nil {
+		w.stats.addDownload(buffer.Len())
+	}
+	return
+}
@@ -0,0 +1,65 @@
+package mux
+
+import (
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+var ErrSessionClosed = E.New("multiplex session closed")
+
+// Tracer is a set of hooks run at stages of the session and stream lifecycle, in the manner of
+// net/http/httptrace. Any hook may be nil, and hooks may be called concurrently.
+type Tracer struct {
+	// OnSessionDial is called before the client dials a new session.
+	OnSessionDial func()
+	// OnSessionEstablished is called once a session is ready to carry streams,
+	// after the TCP Brutal exchange if enabled.
+	OnSessionEstablished func(protocol string)
+	// OnSessionClosed is called once when an established session is closed, with the error that ended it.
+	// The client reports nil for sessions it closes on purpose, and ErrSessionClosed for sessions
+	// it finds closed by the peer or the connection.
+	OnSessionClosed func(err error)
+	// OnStreamOpen is called when the client opens a stream, or the server accepts one.
+	OnStreamOpen func(destination M.Socksaddr, network string)
+	// OnStreamResponse is called when the client reads the stream response,
+	// with nil on success, or the remote or read error.
+	OnStreamResponse func(err error)
+	// OnBrutalNegotiated is called with the negotiated TCP Brutal send rate once it is applied to the session.
+	OnBrutalNegotiated func(sendBPS uint64)
+}
+
+func (t *Tracer) sessionDial() {
+	if t != nil && t.OnSessionDial != nil {
+		t.OnSessionDial()
+	}
+}
+
+func (t *Tracer) sessionEstablished(protocol byte) {
+	if t != nil && t.OnSessionEstablished != nil {
+		t.OnSessionEstablished(protocolName(protocol))
+	}
+}
+
+func (t *Tracer) sessionClosed(err error) {
+	if t != nil && t.OnSessionClosed != nil {
+		t.OnSessionClosed(err)
+	}
+}
+
+func (t *Tracer) streamOpen(destination M.Socksaddr, network string) {
+	if t != nil && t.OnStreamOpen != nil {
+		t.OnStreamOpen(destination, network)
+	}
+}
+
+func (t *Tracer) streamResponse(err error) {
+	if t != nil && t.OnStreamResponse != nil {
+		t.OnStreamResponse(err)
+	}
+}
+
+func (t *Tracer) brutalNegotiated(sendBPS uint64) {
+	if t != nil && t.OnBrutalNegotiated != nil {
+		t.OnBrutalNegotiated(sendBPS)
+	}
+}